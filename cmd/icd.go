@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/JulianaOsi/medhelp/pkg/icd"
+	"github.com/JulianaOsi/medhelp/pkg/store"
+)
+
+// importIcd10 loads the ICD-10 catalog from a CSV or XML file. Running it
+// again with a newer file updates the titles and hierarchy.
+func importIcd10(args []string) error {
+	flags := flag.NewFlagSet("icd-import", flag.ExitOnError)
+	format := flags.String("format", "", "file format, csv or xml; detected from the file extension by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: icd-import [-format csv|xml] FILE")
+	}
+	path := flags.Arg(0)
+
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	codes, err := icd.Read(file, *format)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if len(codes) == 0 {
+		return fmt.Errorf("no codes found in %s", path)
+	}
+
+	if err := store.DB.ImportIcd10(context.Background(), codes); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d ICD-10 codes\n", len(codes))
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/JulianaOsi/medhelp/pkg/config"
+	"github.com/JulianaOsi/medhelp/pkg/store"
+)
+
+// createInvite issues an invite from the command line. It is the only way to
+// get the first admin account, since invites are otherwise created by admins.
+func createInvite(args []string) error {
+	flags := flag.NewFlagSet("invite", flag.ExitOnError)
+	organization := flags.String("organization", "", "organization the invited user belongs to")
+	role := flags.String("role", "admin", "role granted by the invite")
+	lifetime := flags.Duration("lifetime", config.InviteLifetime, "how long the invite stays valid")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *organization == "" {
+		return fmt.Errorf("organization is required")
+	}
+
+	invite, err := store.DB.CreateInvite(context.Background(), store.NewInvite{
+		Organization: *organization,
+		Role:         *role,
+		ExpiresAt:    time.Now().Add(*lifetime),
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Invite code for %s (%s), valid until %s:\n%s\n",
+		invite.Role, invite.Organization, invite.ExpiresAt.Format(time.RFC3339), invite.Code)
+	return nil
+}
@@ -1,27 +1,66 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
 
 	_ "github.com/lib/pq"
 
 	"github.com/JulianaOsi/medhelp/pkg/config"
+	"github.com/JulianaOsi/medhelp/pkg/logging"
 	migrations "github.com/JulianaOsi/medhelp/pkg/migration"
 	"github.com/JulianaOsi/medhelp/pkg/server"
 	"github.com/JulianaOsi/medhelp/pkg/store"
+	"github.com/JulianaOsi/medhelp/pkg/tracing"
 )
 
 func main() {
-	conf := config.ReadConfig()
+	conf, args, err := config.ReadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("failed to read config: %v\n", err)
+	}
+
+	if err := logging.Configure(conf.Log.Level, conf.Log.Format); err != nil {
+		log.Fatalf("failed to configure logging: %v\n", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), &conf.Tracing)
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v\n", err)
+	}
+	defer shutdownTracing(context.Background())
 
-	err := migrations.UpMigrations(conf)
+	err = migrations.UpMigrations(conf)
 	if err != nil {
 		log.Fatalf("failed to update migrations: %v\n", err)
 	}
 
-	if err := store.InitDB(conf.DB); err != nil {
+	if err := store.InitDB(conf.DB, conf.Storage); err != nil {
 		log.Fatalf("failed to create store: %v\n", err)
 	}
 
-	server.LaunchServer()
+	if len(args) > 0 && args[0] == "invite" {
+		err = createInvite(args[1:])
+		store.DB.Close()
+		if err != nil {
+			log.Fatalf("failed to create invite: %v\n", err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "icd-import" {
+		err = importIcd10(args[1:])
+		store.DB.Close()
+		if err != nil {
+			log.Fatalf("failed to import icd10: %v\n", err)
+		}
+		return
+	}
+
+	err = server.LaunchServer(&conf.Server)
+	store.DB.Close()
+	if err != nil {
+		log.Fatalf("server stopped: %v\n", err)
+	}
 }
@@ -6,8 +6,18 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/doug-martin/goqu/v9 v9.10.0
 	github.com/gorilla/mux v1.8.0
+	github.com/jackc/pgconn v1.7.2
 	github.com/jackc/pgx/v4 v4.9.2
 	github.com/lib/pq v1.3.0
+	github.com/minio/minio-go/v7 v7.0.10
 	github.com/pressly/goose v2.6.0+incompatible
-	github.com/sirupsen/logrus v1.4.2
+	github.com/prometheus/client_golang v1.9.0
+	github.com/sirupsen/logrus v1.6.0
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	golang.org/x/crypto v0.0.0-20200709230013-948cd5f35899
+	gopkg.in/yaml.v2 v2.4.0
 )
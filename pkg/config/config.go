@@ -1,24 +1,339 @@
 package config
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/JulianaOsi/medhelp/pkg/filestore"
 	"github.com/JulianaOsi/medhelp/pkg/store"
 )
 
+// SigningKey and the lifetimes below are read by the auth code on every
+// request, so ReadConfig copies them out of the loaded Config.
 var SigningKey = []byte("")
-var DBPassword = ""
+
+// AccessTokenLifetime is kept short because access tokens are checked against
+// the session only by id; RefreshTokenLifetime bounds how long a session lives
+// without the user entering the password again.
+var AccessTokenLifetime = 15 * time.Minute
+var RefreshTokenLifetime = 30 * 24 * time.Hour
+
+// InviteLifetime is used when an invite is created without an explicit expiry.
+var InviteLifetime = 72 * time.Hour
+
+// MaxUploadSize is the largest analysis file, in bytes, the server accepts.
+var MaxUploadSize int64 = 100 << 20
+
+// UploadExpiry is how long a resumable upload may go without receiving data
+// before it is abandoned.
+var UploadExpiry = 24 * time.Hour
+
+const envPrefix = "MEDHELP_"
 
 type Config struct {
-	DB *store.ConfigDB
+	Server  ServerConfig      `yaml:"server"`
+	Log     LogConfig         `yaml:"log"`
+	Tracing TracingConfig     `yaml:"tracing"`
+	Auth    AuthConfig        `yaml:"auth"`
+	DB      *store.ConfigDB   `yaml:"db"`
+	Storage *filestore.Config `yaml:"storage"`
+}
+
+type ServerConfig struct {
+	Listen      string   `yaml:"listen"`
+	CORSOrigins []string `yaml:"cors_origins"`
+
+	// ReadTimeout and WriteTimeout cover the whole request and response, so
+	// they have to leave room for large analysis files on slow connections.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests may take to finish once
+	// the server has been asked to stop.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// MaxUploadSize is in bytes.
+	MaxUploadSize int64         `yaml:"max_upload_size"`
+	UploadExpiry  time.Duration `yaml:"upload_expiry"`
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"`
+	// Format is either "text" or "json".
+	Format string `yaml:"format"`
+}
+
+type TracingConfig struct {
+	// Exporter is "none", "stdout" or "otlp".
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of an OTLP/HTTP collector.
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type AuthConfig struct {
+	SigningKey           string        `yaml:"signing_key"`
+	AccessTokenLifetime  time.Duration `yaml:"access_token_lifetime"`
+	RefreshTokenLifetime time.Duration `yaml:"refresh_token_lifetime"`
+	InviteLifetime       time.Duration `yaml:"invite_lifetime"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Listen:            ":8080",
+			CORSOrigins:       []string{"*"},
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       10 * time.Minute,
+			WriteTimeout:      10 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   2 * time.Minute,
+			MaxUploadSize:     MaxUploadSize,
+			UploadExpiry:      UploadExpiry,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			Endpoint:    "localhost:4318",
+			SampleRatio: 1,
+		},
+		Auth: AuthConfig{
+			AccessTokenLifetime:  AccessTokenLifetime,
+			RefreshTokenLifetime: RefreshTokenLifetime,
+			InviteLifetime:       InviteLifetime,
+		},
+		DB: &store.ConfigDB{
+			Host: "127.0.0.1",
+			Port: "5432",
+			Name: "medhelp",
+			User: "postgres",
+		},
+		Storage: &filestore.Config{
+			Driver: "local",
+			Path:   "files",
+		},
+	}
+}
+
+// ReadConfig builds the configuration from defaults, an optional YAML file,
+// MEDHELP_* environment variables and command line flags, each overriding
+// the previous one. It returns the arguments left after the flags, so a
+// subcommand can follow them.
+func ReadConfig(args []string) (*Config, []string, error) {
+	conf := defaultConfig()
+
+	flags := flag.NewFlagSet("medhelp", flag.ExitOnError)
+	path := flags.String("config", os.Getenv(envPrefix+"CONFIG"), "path to the YAML config file")
+	listen := flags.String("listen", "", "address the HTTP server listens on")
+	dbHost := flags.String("db-host", "", "database host")
+	dbPort := flags.String("db-port", "", "database port")
+	dbName := flags.String("db-name", "", "database name")
+	dbUser := flags.String("db-user", "", "database user")
+	storageDriver := flags.String("storage-driver", "", "file storage driver, local or s3")
+	storagePath := flags.String("storage-path", "", "directory for uploaded files")
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *path != "" {
+		if err := conf.readFile(*path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := conf.readEnv(); err != nil {
+		return nil, nil, err
+	}
+
+	setString(&conf.Server.Listen, *listen)
+	setString(&conf.DB.Host, *dbHost)
+	setString(&conf.DB.Port, *dbPort)
+	setString(&conf.DB.Name, *dbName)
+	setString(&conf.DB.User, *dbUser)
+	setString(&conf.Storage.Driver, *storageDriver)
+	setString(&conf.Storage.Path, *storagePath)
+
+	if err := conf.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	SigningKey = []byte(conf.Auth.SigningKey)
+	AccessTokenLifetime = conf.Auth.AccessTokenLifetime
+	RefreshTokenLifetime = conf.Auth.RefreshTokenLifetime
+	InviteLifetime = conf.Auth.InviteLifetime
+	MaxUploadSize = conf.Server.MaxUploadSize
+	UploadExpiry = conf.Server.UploadExpiry
+
+	return conf, flags.Args(), nil
 }
 
-func ReadConfig() *Config {
-	db := &store.ConfigDB{
-		Host:     "127.0.0.1",
-		Port:     "5432",
-		Name:     "medhelp",
-		User:     "postgres",
-		Password: DBPassword,
+// Validate refuses configurations the server can't run safely with.
+func (c *Config) Validate() error {
+	if c.Auth.SigningKey == "" {
+		return errors.New("auth.signing_key is required")
+	}
+	if c.Auth.AccessTokenLifetime <= 0 || c.Auth.RefreshTokenLifetime <= 0 || c.Auth.InviteLifetime <= 0 {
+		return errors.New("auth token lifetimes must be positive")
+	}
+	if c.Server.Listen == "" {
+		return errors.New("server.listen is required")
+	}
+	if c.Server.ReadHeaderTimeout < 0 || c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 ||
+		c.Server.IdleTimeout < 0 || c.Server.ShutdownTimeout < 0 {
+		return errors.New("server timeouts must not be negative")
+	}
+	if c.Server.MaxUploadSize <= 0 {
+		return errors.New("server.max_upload_size must be positive")
+	}
+	if c.Server.UploadExpiry <= 0 {
+		return errors.New("server.upload_expiry must be positive")
+	}
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("log.level: %v", err)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return errors.New("log.format must be text or json")
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Tracing.Endpoint == "" {
+			return errors.New("tracing.endpoint is required for the otlp exporter")
+		}
+	default:
+		return errors.New("tracing.exporter must be none, stdout or otlp")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return errors.New("tracing.sample_ratio must be between 0 and 1")
+	}
+	if c.DB.Host == "" || c.DB.Port == "" || c.DB.Name == "" || c.DB.User == "" {
+		return errors.New("db.host, db.port, db.name and db.user are required")
+	}
+	switch c.Storage.Driver {
+	case "local":
+		if c.Storage.Path == "" {
+			return errors.New("storage.path is required for the local driver")
+		}
+	case "s3":
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			return errors.New("storage.s3.endpoint and storage.s3.bucket are required for the s3 driver")
+		}
+	default:
+		return errors.New("storage.driver must be local or s3")
+	}
+	return nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) readEnv() error {
+	setString(&c.Server.Listen, os.Getenv(envPrefix+"LISTEN"))
+	setString(&c.Log.Level, os.Getenv(envPrefix+"LOG_LEVEL"))
+	setString(&c.Log.Format, os.Getenv(envPrefix+"LOG_FORMAT"))
+	setString(&c.Tracing.Exporter, os.Getenv(envPrefix+"TRACING_EXPORTER"))
+	setString(&c.Tracing.Endpoint, os.Getenv(envPrefix+"TRACING_ENDPOINT"))
+	setString(&c.Auth.SigningKey, os.Getenv(envPrefix+"SIGNING_KEY"))
+	setString(&c.DB.Host, os.Getenv(envPrefix+"DB_HOST"))
+	setString(&c.DB.Port, os.Getenv(envPrefix+"DB_PORT"))
+	setString(&c.DB.Name, os.Getenv(envPrefix+"DB_NAME"))
+	setString(&c.DB.User, os.Getenv(envPrefix+"DB_USER"))
+	setString(&c.DB.Password, os.Getenv(envPrefix+"DB_PASSWORD"))
+	setString(&c.Storage.Driver, os.Getenv(envPrefix+"STORAGE_DRIVER"))
+	setString(&c.Storage.Path, os.Getenv(envPrefix+"STORAGE_PATH"))
+	setString(&c.Storage.S3.Endpoint, os.Getenv(envPrefix+"S3_ENDPOINT"))
+	setString(&c.Storage.S3.Region, os.Getenv(envPrefix+"S3_REGION"))
+	setString(&c.Storage.S3.Bucket, os.Getenv(envPrefix+"S3_BUCKET"))
+	setString(&c.Storage.S3.Prefix, os.Getenv(envPrefix+"S3_PREFIX"))
+	setString(&c.Storage.S3.AccessKey, os.Getenv(envPrefix+"S3_ACCESS_KEY"))
+	setString(&c.Storage.S3.SecretKey, os.Getenv(envPrefix+"S3_SECRET_KEY"))
+
+	if origins := os.Getenv(envPrefix + "CORS_ORIGINS"); origins != "" {
+		c.Server.CORSOrigins = strings.Split(origins, ",")
+	}
+
+	if size := os.Getenv(envPrefix + "MAX_UPLOAD_SIZE"); size != "" {
+		value, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse %sMAX_UPLOAD_SIZE: %v", envPrefix, err)
+		}
+		c.Server.MaxUploadSize = value
+	}
+
+	if ratio := os.Getenv(envPrefix + "TRACING_SAMPLE_RATIO"); ratio != "" {
+		value, err := strconv.ParseFloat(ratio, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse %sTRACING_SAMPLE_RATIO: %v", envPrefix, err)
+		}
+		c.Tracing.SampleRatio = value
 	}
 
-	return &Config{DB: db}
+	flags := map[string]*bool{
+		"TRACING_INSECURE": &c.Tracing.Insecure,
+		"S3_USE_SSL":       &c.Storage.S3.UseSSL,
+		"S3_PATH_STYLE":    &c.Storage.S3.PathStyle,
+	}
+	for name, target := range flags {
+		value := os.Getenv(envPrefix + name)
+		if value == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s%s: %v", envPrefix, name, err)
+		}
+		*target = b
+	}
+
+	durations := map[string]*time.Duration{
+		"READ_HEADER_TIMEOUT":    &c.Server.ReadHeaderTimeout,
+		"READ_TIMEOUT":           &c.Server.ReadTimeout,
+		"WRITE_TIMEOUT":          &c.Server.WriteTimeout,
+		"IDLE_TIMEOUT":           &c.Server.IdleTimeout,
+		"SHUTDOWN_TIMEOUT":       &c.Server.ShutdownTimeout,
+		"UPLOAD_EXPIRY":          &c.Server.UploadExpiry,
+		"ACCESS_TOKEN_LIFETIME":  &c.Auth.AccessTokenLifetime,
+		"REFRESH_TOKEN_LIFETIME": &c.Auth.RefreshTokenLifetime,
+		"INVITE_LIFETIME":        &c.Auth.InviteLifetime,
+	}
+	for name, target := range durations {
+		value := os.Getenv(envPrefix + name)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s%s: %v", envPrefix, name, err)
+		}
+		*target = d
+	}
+	return nil
+}
+
+func setString(target *string, value string) {
+	if value != "" {
+		*target = value
+	}
 }
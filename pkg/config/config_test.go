@@ -0,0 +1,90 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr string
+	}{
+		{name: "defaults with a signing key", change: func(c *Config) {}},
+		{name: "otlp exporter", change: func(c *Config) { c.Tracing.Exporter = "otlp" }},
+		{name: "stdout exporter", change: func(c *Config) { c.Tracing.Exporter = "stdout" }},
+		{name: "json logs at debug", change: func(c *Config) { c.Log.Format, c.Log.Level = "json", "debug" }},
+		{name: "no sampling", change: func(c *Config) { c.Tracing.SampleRatio = 0 }},
+		{name: "zero timeouts", change: func(c *Config) { c.Server.ReadTimeout, c.Server.WriteTimeout = 0, 0 }},
+		{
+			name: "s3 storage",
+			change: func(c *Config) {
+				c.Storage.Driver = "s3"
+				c.Storage.S3.Endpoint = "minio:9000"
+				c.Storage.S3.Bucket = "analyses"
+			},
+		},
+
+		{name: "no signing key", change: func(c *Config) { c.Auth.SigningKey = "" }, wantErr: "auth.signing_key"},
+		{
+			name:    "zero access token lifetime",
+			change:  func(c *Config) { c.Auth.AccessTokenLifetime = 0 },
+			wantErr: "lifetimes",
+		},
+		{
+			name:    "negative refresh token lifetime",
+			change:  func(c *Config) { c.Auth.RefreshTokenLifetime = -time.Hour },
+			wantErr: "lifetimes",
+		},
+		{name: "zero invite lifetime", change: func(c *Config) { c.Auth.InviteLifetime = 0 }, wantErr: "lifetimes"},
+		{name: "no listen address", change: func(c *Config) { c.Server.Listen = "" }, wantErr: "server.listen"},
+		{
+			name:    "negative timeout",
+			change:  func(c *Config) { c.Server.ShutdownTimeout = -time.Second },
+			wantErr: "timeouts",
+		},
+		{name: "zero upload size", change: func(c *Config) { c.Server.MaxUploadSize = 0 }, wantErr: "max_upload_size"},
+		{name: "negative upload size", change: func(c *Config) { c.Server.MaxUploadSize = -1 }, wantErr: "max_upload_size"},
+		{name: "zero upload expiry", change: func(c *Config) { c.Server.UploadExpiry = 0 }, wantErr: "upload_expiry"},
+		{name: "unknown log level", change: func(c *Config) { c.Log.Level = "verbose" }, wantErr: "log.level"},
+		{name: "unknown log format", change: func(c *Config) { c.Log.Format = "xml" }, wantErr: "log.format"},
+		{name: "unknown exporter", change: func(c *Config) { c.Tracing.Exporter = "jaeger" }, wantErr: "tracing.exporter"},
+		{
+			name:    "otlp exporter without endpoint",
+			change:  func(c *Config) { c.Tracing.Exporter, c.Tracing.Endpoint = "otlp", "" },
+			wantErr: "tracing.endpoint",
+		},
+		{name: "negative sampling", change: func(c *Config) { c.Tracing.SampleRatio = -0.1 }, wantErr: "sample_ratio"},
+		{name: "sampling above 1", change: func(c *Config) { c.Tracing.SampleRatio = 1.5 }, wantErr: "sample_ratio"},
+		{name: "no db host", change: func(c *Config) { c.DB.Host = "" }, wantErr: "db.host"},
+		{name: "no db user", change: func(c *Config) { c.DB.User = "" }, wantErr: "db.host"},
+		{name: "unknown storage driver", change: func(c *Config) { c.Storage.Driver = "gcs" }, wantErr: "storage.driver"},
+		{name: "local storage without path", change: func(c *Config) { c.Storage.Path = "" }, wantErr: "storage.path"},
+		{
+			name:    "s3 storage without bucket",
+			change:  func(c *Config) { c.Storage.Driver, c.Storage.S3.Endpoint = "s3", "minio:9000" },
+			wantErr: "storage.s3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := defaultConfig()
+			conf.Auth.SigningKey = "secret"
+			tt.change(conf)
+
+			err := conf.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Package filestore keeps uploaded analysis files in a backend chosen in the
+// configuration: a local directory or an S3-compatible object store.
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrNotExist is returned when there is no file with the given name.
+var ErrNotExist = errors.New("file does not exist")
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+// Reader reads a stored file. Seeking lets a file be served in ranges
+// without reading it from the start.
+type Reader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// FileStorage stores files under flat names chosen by the caller. Names must
+// not contain path separators.
+type FileStorage interface {
+	// Put stores the content of r under name, replacing any file with that
+	// name. Size is -1 if unknown. It returns the number of bytes stored.
+	Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) (int64, error)
+	// Get opens the file for reading. The caller must close it.
+	Get(ctx context.Context, name string) (Reader, *FileInfo, error)
+	Delete(ctx context.Context, name string) error
+	Stat(ctx context.Context, name string) (*FileInfo, error)
+}
+
+// Config selects and configures the backend. Path is used by the local
+// driver and S3 by the s3 driver.
+type Config struct {
+	Driver string   `yaml:"driver"`
+	Path   string   `yaml:"path"`
+	S3     S3Config `yaml:"s3"`
+}
+
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	UseSSL    bool   `yaml:"use_ssl"`
+	// PathStyle addresses the bucket in the path rather than in the host
+	// name, as MinIO and most self-hosted stores expect.
+	PathStyle bool `yaml:"path_style"`
+}
+
+// New creates the backend selected by conf.Driver.
+func New(ctx context.Context, conf *Config) (FileStorage, error) {
+	switch conf.Driver {
+	case "", "local":
+		return NewLocal(conf.Path)
+	case "s3":
+		return NewS3(ctx, &conf.S3)
+	}
+	return nil, fmt.Errorf("unknown file storage driver %q", conf.Driver)
+}
@@ -0,0 +1,126 @@
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Local keeps files in a directory of the local filesystem.
+type Local struct {
+	dir string
+}
+
+// NewLocal creates the directory if needed.
+func NewLocal(path string) (*Local, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve storage path: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %v", err)
+	}
+
+	return &Local{dir: dir}, nil
+}
+
+// Put writes to a temporary file first, so readers never see a partly
+// written file.
+func (l *Local) Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) (int64, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := ioutil.TempFile(l.dir, ".upload-")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	written, err := io.Copy(f, r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write file: %v", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed to move file into place: %v", err)
+	}
+
+	return written, nil
+}
+
+func (l *Local) Get(ctx context.Context, name string) (Reader, *FileInfo, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to stat file: %v", err)
+	}
+
+	return f, localInfo(stat), nil
+}
+
+func (l *Local) Delete(ctx context.Context, name string) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove file: %v", err)
+	}
+	return nil
+}
+
+func (l *Local) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %v", err)
+	}
+
+	return localInfo(stat), nil
+}
+
+func (l *Local) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return filepath.Join(l.dir, name), nil
+}
+
+// localInfo leaves ContentType empty, since the filesystem doesn't keep it.
+func localInfo(stat os.FileInfo) *FileInfo {
+	return &FileInfo{Size: stat.Size(), ModTime: stat.ModTime()}
+}
@@ -0,0 +1,202 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	storage, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocal() failed: %v", err)
+	}
+
+	testFileStorage(t, storage)
+}
+
+func TestLocalCreatesDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "files", "analyses")
+
+	if _, err := NewLocal(dir); err != nil {
+		t.Fatalf("NewLocal() failed: %v", err)
+	}
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		t.Errorf("the storage directory wasn't created: %v", err)
+	}
+}
+
+func TestLocalNames(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	storage, err := NewLocal(filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatalf("NewLocal() failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{name: "plain", file: "3f2a9c"},
+		{name: "with extension", file: "analysis.pdf"},
+		{name: "hidden", file: ".analysis"},
+		{name: "empty", file: "", wantErr: true},
+		{name: "current directory", file: ".", wantErr: true},
+		{name: "parent directory", file: "..", wantErr: true},
+		{name: "subdirectory", file: "a/b", wantErr: true},
+		{name: "outside the directory", file: "../escaped", wantErr: true},
+		{name: "absolute", file: "/tmp/escaped", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := storage.Put(ctx, tt.file, strings.NewReader("content"), 7, "text/plain")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Put(%q) succeeded, want an error", tt.file)
+				}
+				if _, _, err := storage.Get(ctx, tt.file); err == nil || errors.Is(err, ErrNotExist) {
+					t.Errorf("Get(%q) = %v, want an invalid name error", tt.file, err)
+				}
+				if _, err := storage.Stat(ctx, tt.file); err == nil || errors.Is(err, ErrNotExist) {
+					t.Errorf("Stat(%q) = %v, want an invalid name error", tt.file, err)
+				}
+				if err := storage.Delete(ctx, tt.file); err == nil || errors.Is(err, ErrNotExist) {
+					t.Errorf("Delete(%q) = %v, want an invalid name error", tt.file, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Put(%q) failed: %v", tt.file, err)
+			}
+			if err := storage.Delete(ctx, tt.file); err != nil {
+				t.Errorf("Delete(%q) failed: %v", tt.file, err)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside the storage directory")
+	}
+}
+
+// testFileStorage puts, reads and deletes files of several sizes, and checks
+// that missing files are reported as ErrNotExist.
+func testFileStorage(t *testing.T, storage FileStorage) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		content string
+		size    int64
+	}{
+		{name: "known size", content: "%PDF-1.4 analysis", size: 17},
+		{name: "unknown size", content: strings.Repeat("0123456789", 1000), size: -1},
+		{name: "empty", content: "", size: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := strings.ReplaceAll(tt.name, " ", "-")
+			want := int64(len(tt.content))
+
+			written, err := storage.Put(ctx, file, strings.NewReader(tt.content), tt.size, "application/pdf")
+			if err != nil {
+				t.Fatalf("Put() failed: %v", err)
+			}
+			if written != want {
+				t.Errorf("Put() wrote %d bytes, want %d", written, want)
+			}
+
+			info, err := storage.Stat(ctx, file)
+			if err != nil {
+				t.Fatalf("Stat() failed: %v", err)
+			}
+			if info.Size != want {
+				t.Errorf("Stat() size = %d, want %d", info.Size, want)
+			}
+
+			r, info, err := storage.Get(ctx, file)
+			if err != nil {
+				t.Fatalf("Get() failed: %v", err)
+			}
+			if info.Size != want {
+				t.Errorf("Get() size = %d, want %d", info.Size, want)
+			}
+			checkContent(t, r, tt.content)
+
+			if want > 1 {
+				if _, err := r.Seek(1, io.SeekStart); err != nil {
+					t.Fatalf("Seek() failed: %v", err)
+				}
+				checkContent(t, r, tt.content[1:])
+			}
+			r.Close()
+
+			if err := storage.Delete(ctx, file); err != nil {
+				t.Fatalf("Delete() failed: %v", err)
+			}
+			if _, err := storage.Stat(ctx, file); err != ErrNotExist {
+				t.Errorf("Stat() after Delete() = %v, want ErrNotExist", err)
+			}
+		})
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		for _, content := range []string{"first version", "second"} {
+			if _, err := storage.Put(ctx, "replaced", strings.NewReader(content), -1, "text/plain"); err != nil {
+				t.Fatalf("Put() failed: %v", err)
+			}
+		}
+
+		r, _, err := storage.Get(ctx, "replaced")
+		if err != nil {
+			t.Fatalf("Get() failed: %v", err)
+		}
+		checkContent(t, r, "second")
+		r.Close()
+
+		if err := storage.Delete(ctx, "replaced"); err != nil {
+			t.Fatalf("Delete() failed: %v", err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if _, _, err := storage.Get(ctx, "missing"); err != ErrNotExist {
+			t.Errorf("Get() = %v, want ErrNotExist", err)
+		}
+		if _, err := storage.Stat(ctx, "missing"); err != ErrNotExist {
+			t.Errorf("Stat() = %v, want ErrNotExist", err)
+		}
+		if err := storage.Delete(ctx, "missing"); err != ErrNotExist {
+			t.Errorf("Delete() = %v, want ErrNotExist", err)
+		}
+	})
+}
+
+func checkContent(t *testing.T, r io.Reader, want string) {
+	t.Helper()
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("read %q, want %q", shorten(string(got)), shorten(want))
+	}
+}
+
+func shorten(s string) string {
+	if len(s) > 40 {
+		return s[:40] + "..."
+	}
+	return s
+}
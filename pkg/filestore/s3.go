@@ -0,0 +1,133 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const partSize = 16 << 20
+
+// S3 keeps files as objects in a bucket of an S3-compatible store, so that
+// several server replicas share them.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 connects to the store and checks that the bucket exists.
+func NewS3(ctx context.Context, conf *S3Config) (*S3, error) {
+	if conf.Endpoint == "" || conf.Bucket == "" {
+		return nil, errors.New("storage.s3.endpoint and storage.s3.bucket are required")
+	}
+
+	var lookup = minio.BucketLookupAuto
+	if conf.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(conf.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(conf.AccessKey, conf.SecretKey, ""),
+		Secure:       conf.UseSSL,
+		Region:       conf.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %v", err)
+	}
+
+	exists, err := client.BucketExists(ctx, conf.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %s: %v", conf.Bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist", conf.Bucket)
+	}
+
+	return &S3{client: client, bucket: conf.Bucket, prefix: conf.Prefix}, nil
+}
+
+// Put uploads files of unknown size in parts of partSize, so that only one
+// part at a time is buffered in memory.
+func (s *S3) Put(ctx context.Context, name string, r io.Reader, size int64, contentType string) (int64, error) {
+	var opts = minio.PutObjectOptions{ContentType: contentType}
+	if size < 0 {
+		opts.PartSize = partSize
+	}
+
+	info, err := s.client.PutObject(ctx, s.bucket, s.key(name), r, size, opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to put object: %v", err)
+	}
+
+	return info.Size, nil
+}
+
+// Get stats the object before returning it, since GetObject only reports a
+// missing object on the first read. Seeking the returned object makes the
+// next read request only the rest of it.
+func (s *S3) Get(ctx context.Context, name string) (Reader, *FileInfo, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get object: %v", s3Error(err))
+	}
+
+	stat, err := object.Stat()
+	if err != nil {
+		object.Close()
+		if err := s3Error(err); err == ErrNotExist {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("failed to stat object: %v", err)
+	}
+
+	return object, s3Info(stat), nil
+}
+
+func (s *S3) Delete(ctx context.Context, name string) error {
+	if _, err := s.Stat(ctx, name); err != nil {
+		return err
+	}
+
+	if err := s.client.RemoveObject(ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to remove object: %v", err)
+	}
+	return nil
+}
+
+func (s *S3) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	stat, err := s.client.StatObject(ctx, s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		if err := s3Error(err); err == ErrNotExist {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to stat object: %v", err)
+	}
+
+	return s3Info(stat), nil
+}
+
+func (s *S3) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return strings.TrimSuffix(s.prefix, "/") + "/" + name
+}
+
+// s3Error translates a missing object into ErrNotExist.
+func s3Error(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotExist
+	}
+	return err
+}
+
+func s3Info(stat minio.ObjectInfo) *FileInfo {
+	return &FileInfo{Size: stat.Size, ModTime: stat.LastModified, ContentType: stat.ContentType}
+}
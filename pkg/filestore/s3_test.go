@@ -0,0 +1,231 @@
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestS3(t *testing.T) {
+	for _, prefix := range []string{"", "analyses/"} {
+		t.Run("prefix "+strconv.Quote(prefix), func(t *testing.T) {
+			fake := newFakeS3("medhelp")
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			storage, err := NewS3(context.Background(), fakeS3Config(server, "medhelp", prefix))
+			if err != nil {
+				t.Fatalf("NewS3() failed: %v", err)
+			}
+
+			testFileStorage(t, storage)
+
+			if _, err := storage.Put(context.Background(), "report", strings.NewReader("{}"), 2, "application/json"); err != nil {
+				t.Fatalf("Put() failed: %v", err)
+			}
+			if !fake.has(prefix + "report") {
+				t.Errorf("there is no object %q in the bucket, got %v", prefix+"report", fake.keys())
+			}
+
+			info, err := storage.Stat(context.Background(), "report")
+			if err != nil {
+				t.Fatalf("Stat() failed: %v", err)
+			}
+			if info.ContentType != "application/json" {
+				t.Errorf("Stat() content type = %q, want application/json", info.ContentType)
+			}
+		})
+	}
+}
+
+func TestS3MissingBucket(t *testing.T) {
+	server := httptest.NewServer(newFakeS3("medhelp"))
+	defer server.Close()
+
+	if _, err := NewS3(context.Background(), fakeS3Config(server, "archive", "")); err == nil {
+		t.Errorf("NewS3() succeeded for a missing bucket")
+	}
+}
+
+func fakeS3Config(server *httptest.Server, bucket, prefix string) *S3Config {
+	// Without keys the client doesn't sign requests, so the stand-in gets
+	// plain bodies rather than the chunked streaming signature.
+	return &S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    bucket,
+		Prefix:    prefix,
+		PathStyle: true,
+	}
+}
+
+// fakeS3 is an in-memory stand-in for an S3-compatible store with one bucket.
+// It serves only the requests the S3 driver makes: checking the bucket,
+// single and multipart uploads, reading, stating and removing objects.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]*fakeUpload
+	nextId  int
+}
+
+// fakeUpload is a multipart upload in progress. The content type is sent when
+// the upload starts, not when it completes.
+type fakeUpload struct {
+	contentType string
+	parts       map[int][]byte
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: make(map[string]fakeObject),
+		uploads: make(map[string]*fakeUpload),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if path[0] != f.bucket {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(path) == 1 || path[1] == "" {
+		if r.Method != http.MethodHead {
+			writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+
+	key, query := path[1], r.URL.Query()
+	_, initiate := query["uploads"]
+	switch {
+	case r.Method == http.MethodPost && initiate:
+		f.uploads[strconv.Itoa(f.nextId)] = &fakeUpload{
+			contentType: r.Header.Get("Content-Type"),
+			parts:       make(map[int][]byte),
+		}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%d</UploadId>"+
+			"</InitiateMultipartUploadResult>", f.bucket, key, f.nextId)
+		f.nextId++
+
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		upload.parts[number], _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("ETag", strconv.Quote(fmt.Sprintf("part-%d", number)))
+
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(f.uploads, query.Get("uploadId"))
+
+		var numbers []int
+		for number := range upload.parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, upload.parts[number]...)
+		}
+		f.put(key, data, upload.contentType)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>\"multipart\"</ETag>"+
+			"</CompleteMultipartUploadResult>", f.bucket, key)
+
+	case r.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		f.put(key, data, r.Header.Get("Content-Type"))
+		w.Header().Set("ETag", `"single"`)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("ETag", `"object"`)
+		http.ServeContent(w, r, key, object.modTime, bytes.NewReader(object.data))
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) put(key string, data []byte, contentType string) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	f.objects[key] = fakeObject{data: data, contentType: contentType, modTime: time.Now().UTC().Truncate(time.Second)}
+}
+
+func (f *fakeS3) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.objects[key]
+	return ok
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeS3Error answers with an S3 error document. Like S3, it leaves the
+// body out of responses to HEAD requests.
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	xml.NewEncoder(w).Encode(struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: code, Message: code, Resource: r.URL.Path})
+}
@@ -0,0 +1,226 @@
+// Package icd reads the ICD-10 classification from the CSV and XML files
+// published by the national registry of reference data, as well as from
+// simpler files with "code", "title" and "parent" columns.
+package icd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/JulianaOsi/medhelp/pkg/store"
+)
+
+// Column names, in lowercase, that are recognized in a file. The registry
+// links a code to its parent by a numeric record id, simpler files by the
+// parent's code.
+var (
+	codeColumns       = []string{"code", "mkb_code"}
+	titleColumns      = []string{"title", "name", "mkb_name"}
+	parentColumns     = []string{"parent", "parent_code"}
+	idColumns         = []string{"id"}
+	parentIdColumns   = []string{"id_parent", "parent_id"}
+	actualColumns     = []string{"actual"}
+	notActualPrefixes = []string{"0", "false", "n"}
+)
+
+// Read reads the codes from r. Format is "csv" or "xml".
+func Read(r io.Reader, format string) ([]*store.Icd10Code, error) {
+	var records []map[string]string
+	var err error
+
+	switch format {
+	case "csv":
+		records, err = readCSV(r)
+	case "xml":
+		records, err = readXML(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return toCodes(records)
+}
+
+func readCSV(r io.Reader) ([]map[string]string, error) {
+	buf := bufio.NewReader(r)
+
+	header, err := buf.Peek(4096)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	if i := bytes.IndexByte(header, '\n'); i >= 0 {
+		header = header[:i]
+	}
+
+	reader := csv.NewReader(buf)
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	if bytes.Count(header, []byte(";")) > bytes.Count(header, []byte(",")) {
+		reader.Comma = ';'
+	}
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse csv: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("file is empty")
+	}
+
+	var columns = make([]string, len(rows[0]))
+	for i, name := range rows[0] {
+		columns[i] = normalizeName(name)
+	}
+
+	var records = make([]map[string]string, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		record := make(map[string]string, len(row))
+		for i, value := range row {
+			if i < len(columns) {
+				record[columns[i]] = value
+			}
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// readXML treats every element whose children are all plain values, or which
+// only has attributes, as a record, e.g. <entry><ID>1</ID><MKB_CODE>A00</MKB_CODE>...</entry>.
+func readXML(r io.Reader) ([]map[string]string, error) {
+	type element struct {
+		fields   map[string]string
+		text     strings.Builder
+		children bool
+	}
+
+	var records []map[string]string
+	var stack []*element
+
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		if strings.EqualFold(charset, "utf-8") {
+			return input, nil
+		}
+		return nil, fmt.Errorf("unsupported charset %q, convert the file to UTF-8", charset)
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse xml: %v", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(stack) > 0 {
+				stack[len(stack)-1].children = true
+			}
+			e := &element{fields: map[string]string{}}
+			for _, attr := range t.Attr {
+				e.fields[normalizeName(attr.Name.Local)] = attr.Value
+			}
+			stack = append(stack, e)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		case xml.EndElement:
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			if !e.children && len(e.fields) == 0 {
+				if len(stack) > 0 {
+					stack[len(stack)-1].fields[normalizeName(t.Name.Local)] = e.text.String()
+				}
+				continue
+			}
+			if _, ok := lookup(e.fields, codeColumns); ok {
+				records = append(records, e.fields)
+			}
+		}
+	}
+
+	return records, nil
+}
+
+func toCodes(records []map[string]string) ([]*store.Icd10Code, error) {
+	var codes = make([]*store.Icd10Code, 0, len(records))
+	var codeById = map[string]string{}
+	var parentIds = make([]string, 0, len(records))
+
+	for i, record := range records {
+		if actual, ok := lookup(record, actualColumns); ok && hasAnyPrefix(strings.ToLower(actual), notActualPrefixes) {
+			continue
+		}
+
+		code, _ := lookup(record, codeColumns)
+		title, _ := lookup(record, titleColumns)
+		if code == "" {
+			// Some registry versions have records for the classes of the
+			// classification without a code; their children are attached
+			// to the root instead.
+			continue
+		}
+		if title == "" {
+			return nil, fmt.Errorf("record %d: code %s has no title", i+1, code)
+		}
+
+		entry := &store.Icd10Code{Code: strings.ToUpper(code), Title: title}
+		if parent, ok := lookup(record, parentColumns); ok && parent != "" {
+			parent = strings.ToUpper(parent)
+			entry.ParentCode = &parent
+		}
+		if id, ok := lookup(record, idColumns); ok {
+			codeById[id] = entry.Code
+		}
+		parentId, _ := lookup(record, parentIdColumns)
+
+		codes = append(codes, entry)
+		parentIds = append(parentIds, parentId)
+	}
+
+	for i, entry := range codes {
+		if entry.ParentCode != nil || parentIds[i] == "" {
+			continue
+		}
+		if parent, ok := codeById[parentIds[i]]; ok {
+			entry.ParentCode = &parent
+		}
+	}
+
+	return codes, nil
+}
+
+func lookup(record map[string]string, names []string) (string, bool) {
+	for _, name := range names {
+		if value, ok := record[name]; ok {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+}
@@ -0,0 +1,123 @@
+package icd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/JulianaOsi/medhelp/pkg/store"
+)
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		input   string
+		want    []string // "code|title|parent"
+		wantErr bool
+	}{
+		{
+			name:   "simple csv",
+			format: "csv",
+			input: "code,title,parent\n" +
+				"K29,Gastritis and duodenitis,\n" +
+				"K29.7,\"Gastritis, unspecified\",K29\n",
+			want: []string{"K29|Gastritis and duodenitis|", "K29.7|Gastritis, unspecified|K29"},
+		},
+		{
+			name:   "registry csv",
+			format: "csv",
+			input: "\ufeffID;MKB_CODE;MKB_NAME;ID_PARENT;ACTUAL\r\n" +
+				"1;;Некоторые инфекционные и паразитарные болезни;;1\r\n" +
+				"2;A00;Холера;1;1\r\n" +
+				"3;A00.0;Холера, вызванная холерным вибрионом 01, биовар cholerae;2;1\r\n" +
+				"4;A00.1;Устаревшая запись;2;0\r\n" +
+				"5;A00.9;Холера неуточненная;2;1\r\n",
+			want: []string{
+				"A00|Холера|",
+				"A00.0|Холера, вызванная холерным вибрионом 01, биовар cholerae|A00",
+				"A00.9|Холера неуточненная|A00",
+			},
+		},
+		{
+			name:   "parent listed after its child",
+			format: "csv",
+			input:  "id,code,name,parent_id\n2,e11.2, Diabetes with kidney complications ,1\n1,E11,Type 2 diabetes,\n",
+			want:   []string{"E11.2|Diabetes with kidney complications|E11", "E11|Type 2 diabetes|"},
+		},
+		{
+			name:   "unknown parent id",
+			format: "csv",
+			input:  "id,code,name,parent_id\n2,E11.2,Diabetes with kidney complications,99\n",
+			want:   []string{"E11.2|Diabetes with kidney complications|"},
+		},
+		{
+			name:   "actual column in words",
+			format: "csv",
+			input:  "code,title,actual\nA01,Typhoid,true\nA02,Old,false\nA03,Older,No\n",
+			want:   []string{"A01|Typhoid|"},
+		},
+		{name: "header only", format: "csv", input: "code,title\n", want: []string{}},
+		{name: "empty csv", format: "csv", input: "", wantErr: true},
+		{name: "csv code without title", format: "csv", input: "code,title\nA00,\n", wantErr: true},
+		{
+			name:   "registry xml",
+			format: "xml",
+			input: `<?xml version="1.0" encoding="UTF-8"?>
+<data>
+  <entry><ID>2</ID><MKB_CODE>A00</MKB_CODE><MKB_NAME>Холера</MKB_NAME><ID_PARENT>1</ID_PARENT><ACTUAL>1</ACTUAL></entry>
+  <entry><ID>3</ID><MKB_CODE>A00.0</MKB_CODE><MKB_NAME>Холера классическая</MKB_NAME><ID_PARENT>2</ID_PARENT><ACTUAL>1</ACTUAL></entry>
+  <entry><ID>4</ID><MKB_CODE>A00.1</MKB_CODE><MKB_NAME>Устаревшая</MKB_NAME><ID_PARENT>2</ID_PARENT><ACTUAL>0</ACTUAL></entry>
+</data>`,
+			want: []string{"A00|Холера|", "A00.0|Холера классическая|A00"},
+		},
+		{
+			name:   "xml attributes",
+			format: "xml",
+			input: `<codes>
+  <code code="K29" title="Gastritis and duodenitis"/>
+  <code code="K29.7" title="Gastritis, unspecified" parent="K29"/>
+</codes>`,
+			want: []string{"K29|Gastritis and duodenitis|", "K29.7|Gastritis, unspecified|K29"},
+		},
+		{
+			name:    "xml in another charset",
+			format:  "xml",
+			input:   `<?xml version="1.0" encoding="windows-1251"?><data/>`,
+			wantErr: true,
+		},
+		{name: "malformed xml", format: "xml", input: `<data><entry><CODE>A00</CODE></data>`, wantErr: true},
+		{name: "unknown format", format: "json", input: `[]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codes, err := Read(strings.NewReader(tt.input), tt.format)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Read() = %v, want error", format(codes))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read() failed: %v", err)
+			}
+
+			got := format(codes)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Read() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func format(codes []*store.Icd10Code) []string {
+	var lines = make([]string, 0, len(codes))
+	for _, c := range codes {
+		var parent string
+		if c.ParentCode != nil {
+			parent = *c.ParentCode
+		}
+		lines = append(lines, c.Code+"|"+c.Title+"|"+parent)
+	}
+	return lines
+}
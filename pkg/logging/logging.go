@@ -0,0 +1,97 @@
+// Package logging carries a request-scoped logrus entry through the context
+// and keeps patient data out of the logs.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+type contextKey int
+
+const (
+	entryKey contextKey = iota
+	requestIDKey
+)
+
+// scope is shared by everything handling one request, so fields added deep in
+// the middleware chain, such as the user, also show up in the final access log
+// line written by the outermost middleware.
+type scope struct {
+	mu    sync.Mutex
+	entry *logrus.Entry
+}
+
+// NewContext starts a log scope for a request with the given id.
+func NewContext(ctx context.Context, requestID string) context.Context {
+	entry := logrus.WithField("request_id", requestID)
+	ctx = context.WithValue(ctx, requestIDKey, requestID)
+	return context.WithValue(ctx, entryKey, &scope{entry: entry})
+}
+
+// FromContext returns the request's log entry, or a plain entry outside of
+// a request.
+func FromContext(ctx context.Context) *logrus.Entry {
+	s, ok := ctx.Value(entryKey).(*scope)
+	if !ok {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entry
+}
+
+// AddFields adds fields to every later log line of the request.
+func AddFields(ctx context.Context, fields logrus.Fields) {
+	s, ok := ctx.Value(entryKey).(*scope)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entry = s.entry.WithFields(fields)
+}
+
+// RequestID returns the id of the request the context belongs to, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// NewRequestID returns a random 128-bit id in hex.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Configure sets up the standard logger: level, "text" or "json" output and
+// redaction of sensitive data.
+func Configure(level string, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+
+	switch format {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	logrus.AddHook(RedactHook{})
+	return nil
+}
@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// PgxLogger writes pgx log messages to the log entry of the request that ran
+// the query, so a failing statement can be traced back to its request.
+type PgxLogger struct{}
+
+func (PgxLogger) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	entry := FromContext(ctx).WithFields(data)
+
+	switch level {
+	case pgx.LogLevelTrace, pgx.LogLevelDebug:
+		entry.Debug(msg)
+	case pgx.LogLevelInfo:
+		entry.Info(msg)
+	case pgx.LogLevelWarn:
+		entry.Warn(msg)
+	default:
+		entry.Error(msg)
+	}
+}
+
+// PgxLevel maps a logrus level to the pgx level that logs the same messages.
+func PgxLevel(level logrus.Level) pgx.LogLevel {
+	switch level {
+	case logrus.TraceLevel:
+		return pgx.LogLevelTrace
+	case logrus.DebugLevel:
+		return pgx.LogLevelDebug
+	case logrus.InfoLevel:
+		// pgx logs every query at info level, which is too much for normal
+		// operation; errors are still logged.
+		return pgx.LogLevelWarn
+	case logrus.WarnLevel:
+		return pgx.LogLevelWarn
+	default:
+		return pgx.LogLevelError
+	}
+}
@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveFields are dropped from log entries whatever their value is.
+var sensitiveFields = map[string]bool{
+	"first_name":    true,
+	"last_name":     true,
+	"lastname":      true,
+	"patronymic":    true,
+	"name":          true,
+	"birth_date":    true,
+	"policy_number": true,
+	"tel":           true,
+	"phone":         true,
+	"password":      true,
+	"token":         true,
+	"refresh_token": true,
+	"args":          true,
+}
+
+var (
+	// sqlLiteral matches quoted values that goqu inlines into statements.
+	sqlLiteral = regexp.MustCompile(`'(?:[^']|'')*'`)
+	// policyNumber matches the 16-digit compulsory medical insurance number.
+	policyNumber = regexp.MustCompile(`\b\d{16}\b`)
+	// phoneNumber matches Russian phone numbers in the usual notations.
+	phoneNumber = regexp.MustCompile(`(?:\+7|\b8)[\s\-]?\(?\d{3}\)?[\s\-]?\d{3}[\s\-]?\d{2}[\s\-]?\d{2}\b`)
+)
+
+// RedactHook removes patient names, policy numbers and phone numbers from
+// log entries before they are written.
+type RedactHook struct{}
+
+func (RedactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (RedactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+
+	// entry.Data is shared with the entry the line was logged from, so the
+	// redacted fields go into a copy.
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch {
+		case sensitiveFields[strings.ToLower(key)]:
+			data[key] = redacted
+		case key == "sql":
+			data[key] = RedactSQL(fmt.Sprint(value))
+		default:
+			if s, ok := value.(string); ok {
+				value = Redact(s)
+			} else if err, ok := value.(error); ok {
+				value = Redact(err.Error())
+			}
+			data[key] = value
+		}
+	}
+	entry.Data = data
+	return nil
+}
+
+// Redact masks policy and phone numbers in free text.
+func Redact(s string) string {
+	s = policyNumber.ReplaceAllString(s, redacted)
+	return phoneNumber.ReplaceAllString(s, redacted)
+}
+
+// RedactSQL masks every string literal in a SQL statement, which covers names
+// and other values inlined by the query builder.
+func RedactSQL(sql string) string {
+	return Redact(sqlLiteral.ReplaceAllString(sql, "'?'"))
+}
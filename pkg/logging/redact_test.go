@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"direction 42 created", "direction 42 created"},
+		{"policy 1234567890123456 not found", "policy [REDACTED] not found"},
+		{"policy=1234567890123456", "policy=[REDACTED]"},
+		{"15 digits 123456789012345", "15 digits 123456789012345"},
+		{"17 digits 12345678901234567", "17 digits 12345678901234567"},
+		{"call +7 (912) 345-67-89 today", "call [REDACTED] today"},
+		{"call +79123456789", "call [REDACTED]"},
+		{"call 8-912-345-67-89", "call [REDACTED]"},
+		{"call 8 912 345 67 89", "call [REDACTED]"},
+		{"call 89123456789", "call [REDACTED]"},
+		{"id 189123456789", "id 189123456789"},
+		{"tel 8912345678", "tel 8912345678"},
+		{
+			"1234567890123456 and +79123456789",
+			"[REDACTED] and [REDACTED]",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactSQL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{
+			`SELECT "id" FROM "direction" WHERE ("patient_id" = 7)`,
+			`SELECT "id" FROM "direction" WHERE ("patient_id" = 7)`,
+		},
+		{
+			`SELECT * FROM "patient" WHERE ("last_name" = 'Иванов')`,
+			`SELECT * FROM "patient" WHERE ("last_name" = '?')`,
+		},
+		{
+			`INSERT INTO "patient" ("first_name", "last_name") VALUES ('Sean', 'O''Brien')`,
+			`INSERT INTO "patient" ("first_name", "last_name") VALUES ('?', '?')`,
+		},
+		{
+			`UPDATE "patient" SET "tel"='' WHERE ("id" = 3)`,
+			`UPDATE "patient" SET "tel"='?' WHERE ("id" = 3)`,
+		},
+		{
+			`SELECT * FROM "patient" WHERE ("policy_number" = 1234567890123456)`,
+			`SELECT * FROM "patient" WHERE ("policy_number" = [REDACTED])`,
+		},
+		{
+			`SELECT * FROM "patient" WHERE ("note" = 'it''s ''quoted''')`,
+			`SELECT * FROM "patient" WHERE ("note" = '?')`,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := RedactSQL(tt.in); got != tt.want {
+			t.Errorf("RedactSQL(%q) =\n%s\nwant\n%s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactHook(t *testing.T) {
+	data := logrus.Fields{
+		"first_name": "Ivan",
+		"Phone":      "+79123456789",
+		"sql":        `SELECT 1 WHERE "name" = 'Ivan'`,
+		"error":      errors.New("policy 1234567890123456 is taken"),
+		"direction":  42,
+		"path":       "/directions/8-912-345-67-89",
+	}
+	entry := &logrus.Entry{Message: "patient +79123456789", Data: data}
+
+	if err := (RedactHook{}).Fire(entry); err != nil {
+		t.Fatalf("Fire failed: %v", err)
+	}
+
+	want := logrus.Fields{
+		"first_name": redacted,
+		"Phone":      redacted,
+		"sql":        `SELECT 1 WHERE "name" = '?'`,
+		"error":      "policy [REDACTED] is taken",
+		"direction":  42,
+		"path":       "/directions/[REDACTED]",
+	}
+	for key, value := range want {
+		if entry.Data[key] != value {
+			t.Errorf("field %s = %v, want %v", key, entry.Data[key], value)
+		}
+	}
+	if entry.Message != "patient [REDACTED]" {
+		t.Errorf("message = %q, want it redacted", entry.Message)
+	}
+	if data["first_name"] != "Ivan" {
+		t.Errorf("the fields of the original entry were changed")
+	}
+}
@@ -0,0 +1,134 @@
+// Package metrics defines the Prometheus metrics exported on /metrics.
+package metrics
+
+import (
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "medhelp"
+
+var (
+	// HTTPRequests and HTTPDuration are labelled with the mux route template,
+	// e.g. /direction/{id}, so ids don't blow up the label cardinality.
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	FilesSaved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "files",
+		Name:      "saved_total",
+		Help:      "Analysis files saved.",
+	})
+
+	FilesSavedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "files",
+		Name:      "saved_bytes_total",
+		Help:      "Bytes of analysis files saved.",
+	})
+
+	FilesDeduplicated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "files",
+		Name:      "deduplicated_total",
+		Help:      "Uploads identical to an already stored file, which reused it.",
+	})
+
+	FilesDownloaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "files",
+		Name:      "downloaded_total",
+		Help:      "Analysis files downloaded.",
+	})
+
+	FilesDownloadedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "files",
+		Name:      "downloaded_bytes_total",
+		Help:      "Bytes of analysis files sent to clients.",
+	})
+
+	DirectionStatusTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "direction",
+		Name:      "status_transitions_total",
+		Help:      "Direction status changes by previous and new status.",
+	}, []string{"from", "to"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		HTTPRequests,
+		HTTPDuration,
+		FilesSaved,
+		FilesSavedBytes,
+		FilesDeduplicated,
+		FilesDownloaded,
+		FilesDownloadedBytes,
+		DirectionStatusTransitions,
+	)
+}
+
+// RegisterPool exports the statistics of a pgx connection pool.
+func RegisterPool(stat func() *pgxpool.Stat) error {
+	return prometheus.Register(&poolCollector{stat: stat})
+}
+
+type poolCollector struct {
+	stat func() *pgxpool.Stat
+}
+
+var (
+	poolAcquired = prometheus.NewDesc(namespace+"_db_pool_acquired_connections",
+		"Connections currently in use.", nil, nil)
+	poolIdle = prometheus.NewDesc(namespace+"_db_pool_idle_connections",
+		"Idle connections in the pool.", nil, nil)
+	poolTotal = prometheus.NewDesc(namespace+"_db_pool_total_connections",
+		"All connections in the pool, including ones still being opened.", nil, nil)
+	poolMax = prometheus.NewDesc(namespace+"_db_pool_max_connections",
+		"Maximum size of the pool.", nil, nil)
+	poolAcquires = prometheus.NewDesc(namespace+"_db_pool_acquires_total",
+		"Successful connection acquires.", nil, nil)
+	poolWaits = prometheus.NewDesc(namespace+"_db_pool_waits_total",
+		"Acquires that had to wait for a connection.", nil, nil)
+	poolWaitSeconds = prometheus.NewDesc(namespace+"_db_pool_wait_seconds_total",
+		"Time spent waiting for a connection.", nil, nil)
+	poolCanceled = prometheus.NewDesc(namespace+"_db_pool_canceled_acquires_total",
+		"Acquires canceled by their context.", nil, nil)
+)
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquired
+	ch <- poolIdle
+	ch <- poolTotal
+	ch <- poolMax
+	ch <- poolAcquires
+	ch <- poolWaits
+	ch <- poolWaitSeconds
+	ch <- poolCanceled
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.stat()
+	ch <- prometheus.MustNewConstMetric(poolAcquired, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(poolIdle, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(poolTotal, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(poolMax, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(poolAcquires, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolWaits, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolWaitSeconds, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(poolCanceled, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+}
@@ -0,0 +1,26 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upPasswordHash, downPasswordHash)
+}
+
+func upPasswordHash(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE users ALTER COLUMN salt DROP NOT NULL;
+`)
+	return err
+}
+
+func downPasswordHash(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+UPDATE users SET salt = '' WHERE salt IS NULL;
+ALTER TABLE users ALTER COLUMN salt SET NOT NULL;
+`)
+	return err
+}
@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upRefreshTokens, downRefreshTokens)
+}
+
+func upRefreshTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS refresh_tokens
+(
+    id          INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    user_id     INT         NOT NULL,
+    session_id  TEXT        NOT NULL,
+    token_hash  TEXT UNIQUE NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at  TIMESTAMPTZ NOT NULL,
+    revoked_at  TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_id_idx ON refresh_tokens (session_id);
+`)
+	return err
+}
+
+func downRefreshTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DROP TABLE refresh_tokens CASCADE;
+`)
+	return err
+}
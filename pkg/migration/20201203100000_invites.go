@@ -0,0 +1,55 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upInvites, downInvites)
+}
+
+func upInvites(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE users ADD COLUMN IF NOT EXISTS organization TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_idx ON users (username);
+
+CREATE TABLE IF NOT EXISTS invites
+(
+    id           INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    code_hash    TEXT UNIQUE NOT NULL,
+    organization TEXT        NOT NULL,
+    role         TEXT        NOT NULL,
+    created_by   INT,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at   TIMESTAMPTZ NOT NULL,
+    revoked_at   TIMESTAMPTZ,
+    used_at      TIMESTAMPTZ,
+    FOREIGN KEY (created_by) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS invite_uses
+(
+    id          INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    invite_id   INT         NOT NULL,
+    user_id     INT         NOT NULL,
+    used_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    remote_addr TEXT,
+    FOREIGN KEY (invite_id) REFERENCES invites (id),
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+`)
+	return err
+}
+
+func downInvites(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DROP TABLE invite_uses CASCADE;
+DROP TABLE invites CASCADE;
+DROP INDEX users_username_idx;
+ALTER TABLE users DROP COLUMN organization;
+`)
+	return err
+}
@@ -0,0 +1,25 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upDoctorRole, downDoctorRole)
+}
+
+func upDoctorRole(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE invites ADD COLUMN IF NOT EXISTS related_id INT;
+`)
+	return err
+}
+
+func downDoctorRole(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE invites DROP COLUMN related_id;
+`)
+	return err
+}
@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upDoctorUnique, downDoctorUnique)
+}
+
+// upDoctorUnique merges doctors that were added twice by earlier direction
+// uploads into the first of them, so that a doctor can be matched by name and
+// specialty.
+func upDoctorUnique(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TEMPORARY TABLE doctor_duplicate ON COMMIT DROP AS
+SELECT id, keep_id
+FROM (SELECT id, min(id) OVER (PARTITION BY name, specialty) AS keep_id FROM doctor) d
+WHERE id <> keep_id;
+
+UPDATE direction SET doctor_id = d.keep_id
+FROM doctor_duplicate d WHERE direction.doctor_id = d.id;
+
+UPDATE users SET id_related = d.keep_id
+FROM doctor_duplicate d WHERE users.role = 'doctor' AND users.id_related = d.id;
+
+UPDATE invites SET related_id = d.keep_id
+FROM doctor_duplicate d WHERE invites.role = 'doctor' AND invites.related_id = d.id;
+
+DELETE FROM doctor WHERE id IN (SELECT id FROM doctor_duplicate);
+
+ALTER TABLE doctor ADD CONSTRAINT doctor_name_specialty_key UNIQUE (name, specialty);
+`)
+	return err
+}
+
+func downDoctorUnique(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE doctor DROP CONSTRAINT doctor_name_specialty_key;
+`)
+	return err
+}
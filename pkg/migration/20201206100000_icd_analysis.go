@@ -0,0 +1,53 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upIcdAnalysis, downIcdAnalysis)
+}
+
+// upIcdAnalysis lets the server number direction analyses itself and fills
+// icd_analysis with the analyses the seed directions were given by hand.
+func upIcdAnalysis(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE direction_analysis ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY;
+SELECT setval(pg_get_serial_sequence('direction_analysis', 'id'), coalesce(max(id), 0) + 1, false)
+FROM direction_analysis;
+
+ALTER TABLE direction_analysis
+    ADD CONSTRAINT direction_analysis_direction_analysis_key UNIQUE (direction_id, analysis_id);
+
+ALTER TABLE icd_analysis ALTER COLUMN icd_code SET NOT NULL;
+ALTER TABLE icd_analysis ALTER COLUMN analysis_id SET NOT NULL;
+ALTER TABLE icd_analysis
+    ADD CONSTRAINT icd_analysis_analysis_id_fkey FOREIGN KEY (analysis_id) REFERENCES analysis (id);
+
+INSERT INTO icd_analysis (icd_code, analysis_id)
+SELECT icd_code, analysis_id
+FROM (VALUES ('K29', 6),
+             ('K29', 7),
+             ('E10-E14', 3),
+             ('E10-E14', 4),
+             ('E10-E14', 5),
+             ('N20-N23', 0),
+             ('N20-N23', 1),
+             ('N20-N23', 2)) AS rule (icd_code, analysis_id)
+WHERE NOT EXISTS (SELECT 1 FROM icd_analysis);
+`)
+	return err
+}
+
+func downIcdAnalysis(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE icd_analysis DROP CONSTRAINT icd_analysis_analysis_id_fkey;
+ALTER TABLE icd_analysis ALTER COLUMN analysis_id DROP NOT NULL;
+ALTER TABLE icd_analysis ALTER COLUMN icd_code DROP NOT NULL;
+ALTER TABLE direction_analysis DROP CONSTRAINT direction_analysis_direction_analysis_key;
+ALTER TABLE direction_analysis ALTER COLUMN id DROP IDENTITY;
+`)
+	return err
+}
@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upAnalysisCatalog, downAnalysisCatalog)
+}
+
+// upAnalysisCatalog turns analysis into an editable catalog and makes
+// icd_analysis rows immutable versions: a changed rule ends the current row
+// and starts a new one, and each direction analysis remembers the rule it was
+// created by.
+func upAnalysisCatalog(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE analysis ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY;
+SELECT setval(pg_get_serial_sequence('analysis', 'id'), coalesce(max(id), 0) + 1, false)
+FROM analysis;
+
+ALTER TABLE analysis ADD COLUMN IF NOT EXISTS code TEXT;
+UPDATE analysis SET code = 'analysis-' || id WHERE code IS NULL;
+ALTER TABLE analysis ALTER COLUMN code SET NOT NULL;
+ALTER TABLE analysis ADD CONSTRAINT analysis_code_key UNIQUE (code);
+
+ALTER TABLE analysis ADD COLUMN IF NOT EXISTS description   TEXT NOT NULL DEFAULT '';
+ALTER TABLE analysis ADD COLUMN IF NOT EXISTS preparation   TEXT NOT NULL DEFAULT '';
+ALTER TABLE analysis ADD COLUMN IF NOT EXISTS validity_days INT;
+
+ALTER TABLE icd_analysis ADD COLUMN IF NOT EXISTS valid_from  TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE icd_analysis ADD COLUMN IF NOT EXISTS valid_to    TIMESTAMPTZ;
+ALTER TABLE icd_analysis ADD COLUMN IF NOT EXISTS replaces_id INT REFERENCES icd_analysis (id);
+ALTER TABLE icd_analysis ADD COLUMN IF NOT EXISTS created_by  INT REFERENCES users (id);
+UPDATE icd_analysis SET valid_from = (SELECT coalesce(min(date), now()) FROM direction);
+
+ALTER TABLE direction_analysis ADD COLUMN IF NOT EXISTS icd_rule_id INT REFERENCES icd_analysis (id);
+`)
+	return err
+}
+
+func downAnalysisCatalog(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE direction_analysis DROP COLUMN icd_rule_id;
+ALTER TABLE icd_analysis DROP COLUMN created_by;
+ALTER TABLE icd_analysis DROP COLUMN replaces_id;
+DELETE FROM icd_analysis WHERE valid_to IS NOT NULL;
+ALTER TABLE icd_analysis DROP COLUMN valid_to;
+ALTER TABLE icd_analysis DROP COLUMN valid_from;
+ALTER TABLE analysis DROP COLUMN validity_days;
+ALTER TABLE analysis DROP COLUMN preparation;
+ALTER TABLE analysis DROP COLUMN description;
+ALTER TABLE analysis DROP COLUMN code;
+ALTER TABLE analysis ALTER COLUMN id DROP IDENTITY;
+`)
+	return err
+}
@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upIcd10, downIcd10)
+}
+
+// upIcd10 creates the ICD-10 catalog filled by the icd-import command. Codes
+// of chapters and blocks are ranges such as "E10-E14", and parent_code links
+// every code to the chapter, block or category that contains it.
+func upIcd10(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS icd10
+(
+    code        TEXT PRIMARY KEY,
+    title       TEXT NOT NULL,
+    parent_code TEXT
+);
+
+CREATE INDEX IF NOT EXISTS icd10_parent_code_idx ON icd10 (parent_code);
+CREATE INDEX IF NOT EXISTS icd10_title_idx ON icd10 (lower(title));
+`)
+	return err
+}
+
+func downIcd10(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DROP TABLE icd10;
+`)
+	return err
+}
@@ -0,0 +1,63 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upDirectionStatus, downDirectionStatus)
+}
+
+// upDirectionStatus replaces the numeric direction status with a named one.
+// The server only ever set 0 for new directions and 1 once a file was
+// uploaded; any other number was set by hand, so such directions are left
+// for a registrar to review.
+func upDirectionStatus(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE direction ALTER COLUMN status DROP DEFAULT;
+ALTER TABLE direction ALTER COLUMN status TYPE TEXT
+    USING CASE WHEN status IS NULL OR status = 0 THEN 'new' ELSE 'under_review' END;
+ALTER TABLE direction ALTER COLUMN status SET DEFAULT 'new';
+ALTER TABLE direction ALTER COLUMN status SET NOT NULL;
+ALTER TABLE direction ADD CONSTRAINT direction_status_check CHECK (status IN (
+    'new', 'awaiting_analyses', 'under_review', 'approved', 'rejected', 'cancelled', 'completed'
+));
+
+CREATE TABLE IF NOT EXISTS direction_status_history
+(
+    id           INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    direction_id INT         NOT NULL,
+    from_status  TEXT,
+    to_status    TEXT        NOT NULL,
+    changed_by   INT,
+    changed_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    reason       TEXT        NOT NULL DEFAULT '',
+    FOREIGN KEY (direction_id) REFERENCES direction (id),
+    FOREIGN KEY (changed_by) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS direction_status_history_direction_id_idx
+    ON direction_status_history (direction_id, changed_at);
+
+INSERT INTO direction_status_history (direction_id, to_status, reason)
+SELECT id, status, 'status before history was recorded'
+FROM direction;
+`)
+	return err
+}
+
+func downDirectionStatus(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DROP TABLE direction_status_history;
+
+ALTER TABLE direction DROP CONSTRAINT direction_status_check;
+ALTER TABLE direction ALTER COLUMN status DROP NOT NULL;
+ALTER TABLE direction ALTER COLUMN status DROP DEFAULT;
+ALTER TABLE direction ALTER COLUMN status TYPE INT
+    USING CASE WHEN status = 'new' THEN 0 ELSE 1 END;
+ALTER TABLE direction ALTER COLUMN status SET DEFAULT 0;
+`)
+	return err
+}
@@ -0,0 +1,42 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upAnalysisReview, downAnalysisReview)
+}
+
+// upAnalysisReview replaces the is_checked flag of direction analyses with a
+// review state and the reviewer's comment.
+func upAnalysisReview(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE direction_analysis ADD COLUMN IF NOT EXISTS review_state   TEXT NOT NULL DEFAULT 'pending';
+ALTER TABLE direction_analysis ADD COLUMN IF NOT EXISTS review_comment TEXT NOT NULL DEFAULT '';
+ALTER TABLE direction_analysis ADD COLUMN IF NOT EXISTS reviewed_at    TIMESTAMPTZ;
+ALTER TABLE direction_analysis ADD COLUMN IF NOT EXISTS reviewed_by    INT REFERENCES users (id);
+ALTER TABLE direction_analysis ADD CONSTRAINT direction_analysis_review_state_check
+    CHECK (review_state IN ('pending', 'accepted', 'rejected', 'reupload_required'));
+
+UPDATE direction_analysis SET review_state = 'accepted' WHERE is_checked;
+ALTER TABLE direction_analysis DROP COLUMN is_checked;
+`)
+	return err
+}
+
+func downAnalysisReview(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE direction_analysis ADD COLUMN IF NOT EXISTS is_checked BOOLEAN DEFAULT FALSE;
+UPDATE direction_analysis SET is_checked = review_state = 'accepted';
+
+ALTER TABLE direction_analysis DROP CONSTRAINT direction_analysis_review_state_check;
+ALTER TABLE direction_analysis DROP COLUMN reviewed_by;
+ALTER TABLE direction_analysis DROP COLUMN reviewed_at;
+ALTER TABLE direction_analysis DROP COLUMN review_comment;
+ALTER TABLE direction_analysis DROP COLUMN review_state;
+`)
+	return err
+}
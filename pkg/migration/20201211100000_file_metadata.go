@@ -0,0 +1,41 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upFileMetadata, downFileMetadata)
+}
+
+// upFileMetadata records what was uploaded for every file. Files uploaded
+// before this migration have no hash or size, so new uploads are never
+// deduplicated against them.
+func upFileMetadata(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE files ADD COLUMN IF NOT EXISTS sha256        TEXT;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS size          BIGINT;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS original_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS content_type  TEXT NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS created_at    TIMESTAMPTZ NOT NULL DEFAULT now();
+
+UPDATE files SET original_name = name WHERE original_name = '';
+
+CREATE UNIQUE INDEX IF NOT EXISTS files_sha256_key ON files (sha256);
+`)
+	return err
+}
+
+func downFileMetadata(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DROP INDEX files_sha256_key;
+ALTER TABLE files DROP COLUMN created_at;
+ALTER TABLE files DROP COLUMN content_type;
+ALTER TABLE files DROP COLUMN original_name;
+ALTER TABLE files DROP COLUMN size;
+ALTER TABLE files DROP COLUMN sha256;
+`)
+	return err
+}
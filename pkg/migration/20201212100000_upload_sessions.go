@@ -0,0 +1,53 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upUploadSessions, downUploadSessions)
+}
+
+// upUploadSessions creates the state of resumable uploads. Every received
+// chunk is kept in the file storage under its own name until the upload is
+// complete and the chunks are joined into one file.
+func upUploadSessions(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS upload_session
+(
+    id            TEXT PRIMARY KEY,
+    analysis_id   INT NOT NULL,
+    created_by    INT REFERENCES users (id),
+    length        BIGINT NOT NULL,
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    filename      TEXT NOT NULL DEFAULT '',
+    file_id       INT REFERENCES files (id),
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at    TIMESTAMPTZ NOT NULL,
+    CONSTRAINT upload_session_analysis_id_fkey FOREIGN KEY (analysis_id) REFERENCES direction_analysis (id),
+    CONSTRAINT upload_session_offset_check CHECK (upload_offset >= 0 AND upload_offset <= length)
+);
+
+CREATE INDEX IF NOT EXISTS upload_session_expires_at_idx ON upload_session (expires_at);
+
+CREATE TABLE IF NOT EXISTS upload_chunk
+(
+    session_id   TEXT NOT NULL REFERENCES upload_session (id) ON DELETE CASCADE,
+    chunk_offset BIGINT NOT NULL,
+    size         BIGINT NOT NULL,
+    name         TEXT NOT NULL,
+    PRIMARY KEY (session_id, chunk_offset)
+);
+`)
+	return err
+}
+
+func downUploadSessions(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DROP TABLE upload_chunk;
+DROP TABLE upload_session;
+`)
+	return err
+}
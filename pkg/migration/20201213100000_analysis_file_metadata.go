@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upAnalysisFileMetadata, downAnalysisFileMetadata)
+}
+
+// upAnalysisFileMetadata records the name and type every analysis file was
+// uploaded with, since a deduplicated files row keeps those of the first
+// upload only.
+func upAnalysisFileMetadata(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE direction_analysis ADD COLUMN IF NOT EXISTS file_name         TEXT NOT NULL DEFAULT '';
+ALTER TABLE direction_analysis ADD COLUMN IF NOT EXISTS file_content_type TEXT NOT NULL DEFAULT '';
+
+UPDATE direction_analysis
+SET file_name         = files.original_name,
+    file_content_type = files.content_type
+FROM files
+WHERE files.id = direction_analysis.file_id;
+`)
+	return err
+}
+
+func downAnalysisFileMetadata(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE direction_analysis DROP COLUMN file_content_type;
+ALTER TABLE direction_analysis DROP COLUMN file_name;
+`)
+	return err
+}
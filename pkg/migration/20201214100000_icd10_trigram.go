@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upIcd10Trigram, downIcd10Trigram)
+}
+
+// upIcd10Trigram replaces the index on lower(title), which the search can't
+// use for its ILIKE '%query%', with trigram indexes that serve both the
+// substring match on titles and the prefix match on codes.
+func upIcd10Trigram(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+DROP INDEX IF EXISTS icd10_title_idx;
+
+CREATE INDEX IF NOT EXISTS icd10_title_trgm_idx ON icd10 USING gin (title gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS icd10_code_trgm_idx ON icd10 USING gin (code gin_trgm_ops);
+`)
+	return err
+}
+
+func downIcd10Trigram(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DROP INDEX icd10_code_trgm_idx;
+DROP INDEX icd10_title_trgm_idx;
+
+CREATE INDEX IF NOT EXISTS icd10_title_idx ON icd10 (lower(title));
+`)
+	return err
+}
@@ -22,6 +22,7 @@ func UpMigrations(conf *config.Config) error {
 	if err != nil {
 		return fmt.Errorf("goose: failed to open DB: %v\n", err)
 	}
+	defer db.Close()
 
 	return run(db)
 }
@@ -0,0 +1,165 @@
+// Package policy decides which role may perform which action on which
+// resource. It has no database dependency: ownership of a resource is looked
+// up through an OwnershipResolver supplied by the caller.
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrForbidden is returned when the subject is not allowed to perform the
+// action.
+var ErrForbidden = errors.New("access denied")
+
+type Action string
+
+const (
+	Read   Action = "read"
+	Create Action = "create"
+	Update Action = "update"
+	Delete Action = "delete"
+	Upload Action = "upload"
+	Review Action = "review"
+)
+
+type Resource string
+
+const (
+	Direction Resource = "direction"
+	Analysis  Resource = "analysis"
+	Invite    Resource = "invite"
+	// Catalog is the analysis catalog together with the ICD rules that
+	// require its analyses.
+	Catalog Resource = "catalog"
+)
+
+// Access is the extent to which a rule grants an action.
+type Access int
+
+const (
+	// Denied is the zero value, so anything without a rule is denied.
+	Denied Access = iota
+	// Own allows the action only on resources that belong to the subject.
+	Own
+	// Any allows the action on every resource of the kind.
+	Any
+)
+
+type Rule struct {
+	Role     string
+	Action   Action
+	Resource Resource
+}
+
+// DefaultRules is the access matrix used by the server.
+var DefaultRules = map[Rule]Access{
+	{"patient", Read, Direction}:  Own,
+	{"patient", Read, Analysis}:   Own,
+	{"patient", Upload, Analysis}: Own,
+
+	{"doctor", Read, Direction}: Own,
+	{"doctor", Read, Analysis}:  Own,
+
+	{"registrar", Read, Direction}:   Any,
+	{"registrar", Create, Direction}: Any,
+	{"registrar", Update, Direction}: Any,
+	{"registrar", Read, Analysis}:    Any,
+	{"registrar", Upload, Analysis}:  Any,
+	{"registrar", Review, Analysis}:  Any,
+	{"registrar", Delete, Analysis}:  Any,
+	{"registrar", Read, Catalog}:     Any,
+
+	{"admin", Read, Invite}:   Any,
+	{"admin", Create, Invite}: Any,
+	{"admin", Delete, Invite}: Any,
+
+	{"admin", Read, Catalog}:   Any,
+	{"admin", Create, Catalog}: Any,
+	{"admin", Update, Catalog}: Any,
+	{"admin", Delete, Catalog}: Any,
+}
+
+// Subject is the authenticated user a decision is made for. PatientId and
+// DoctorId are set for the patient and doctor roles respectively.
+type Subject struct {
+	UserId    *int
+	Role      string
+	PatientId *int
+	DoctorId  *int
+}
+
+// Owner identifies the patient and the doctor a resource belongs to.
+type Owner struct {
+	PatientId int
+	DoctorId  int
+}
+
+// OwnershipResolver finds the owner of a single resource. It returns nil if
+// the resource does not exist.
+type OwnershipResolver interface {
+	Owner(ctx context.Context, resource Resource, id int) (*Owner, error)
+}
+
+// Target is what an action is performed on: either one resource or the
+// resource collection as a whole.
+type Target struct {
+	Resource Resource
+	Id       *int
+}
+
+func Instance(resource Resource, id int) Target {
+	return Target{Resource: resource, Id: &id}
+}
+
+func Collection(resource Resource) Target {
+	return Target{Resource: resource}
+}
+
+type Policy struct {
+	rules    map[Rule]Access
+	resolver OwnershipResolver
+}
+
+func New(rules map[Rule]Access, resolver OwnershipResolver) *Policy {
+	return &Policy{rules: rules, resolver: resolver}
+}
+
+// Scope returns the access the subject's role has for the action. Handlers
+// that list a collection use it to decide whether to filter by owner.
+func (p *Policy) Scope(subject Subject, action Action, resource Resource) Access {
+	return p.rules[Rule{Role: subject.Role, Action: action, Resource: resource}]
+}
+
+// Authorize returns nil if the subject may perform the action on the target
+// and ErrForbidden otherwise. For a collection target an Own rule is enough;
+// the caller is then expected to narrow the result using Scope.
+func (p *Policy) Authorize(ctx context.Context, subject Subject, action Action, target Target) error {
+	switch p.Scope(subject, action, target.Resource) {
+	case Any:
+		return nil
+	case Own:
+		if target.Id == nil {
+			return nil
+		}
+		owner, err := p.resolver.Owner(ctx, target.Resource, *target.Id)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s owner: %v", target.Resource, err)
+		}
+		if owner != nil && owns(subject, owner) {
+			return nil
+		}
+	}
+	return ErrForbidden
+}
+
+func owns(subject Subject, owner *Owner) bool {
+	switch subject.Role {
+	case "patient":
+		return subject.PatientId != nil && *subject.PatientId == owner.PatientId
+	case "doctor":
+		return subject.DoctorId != nil && *subject.DoctorId == owner.DoctorId
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+var (
+	roles     = []string{"patient", "doctor", "registrar", "admin", ""}
+	actions   = []Action{Read, Create, Update, Delete, Upload, Review}
+	resources = []Resource{Direction, Analysis, Invite, Catalog}
+)
+
+// granted is the access matrix the server is expected to enforce. It repeats
+// DefaultRules on purpose, so that changing a rule takes changing the test.
+// Every combination not listed here must be denied.
+var granted = map[Rule]Access{
+	{"patient", Read, Direction}:  Own,
+	{"patient", Read, Analysis}:   Own,
+	{"patient", Upload, Analysis}: Own,
+
+	{"doctor", Read, Direction}: Own,
+	{"doctor", Read, Analysis}:  Own,
+
+	{"registrar", Read, Direction}:   Any,
+	{"registrar", Create, Direction}: Any,
+	{"registrar", Update, Direction}: Any,
+	{"registrar", Read, Analysis}:    Any,
+	{"registrar", Upload, Analysis}:  Any,
+	{"registrar", Review, Analysis}:  Any,
+	{"registrar", Delete, Analysis}:  Any,
+	{"registrar", Read, Catalog}:     Any,
+
+	{"admin", Read, Invite}:    Any,
+	{"admin", Create, Invite}:  Any,
+	{"admin", Delete, Invite}:  Any,
+	{"admin", Read, Catalog}:   Any,
+	{"admin", Create, Catalog}: Any,
+	{"admin", Update, Catalog}: Any,
+	{"admin", Delete, Catalog}: Any,
+}
+
+const (
+	ownedId   = 10
+	foreignId = 20
+	missingId = 30
+	brokenId  = 40
+)
+
+// fakeResolver knows two resources of every kind: one that belongs to
+// patient 1 and doctor 2, and one that belongs to someone else.
+type fakeResolver struct{}
+
+var errResolver = errors.New("resolver failed")
+
+func (fakeResolver) Owner(ctx context.Context, resource Resource, id int) (*Owner, error) {
+	switch id {
+	case ownedId:
+		return &Owner{PatientId: 1, DoctorId: 2}, nil
+	case foreignId:
+		return &Owner{PatientId: 3, DoctorId: 4}, nil
+	case brokenId:
+		return nil, errResolver
+	}
+	return nil, nil
+}
+
+func subject(role string) Subject {
+	var userId, patientId, doctorId = 100, 1, 2
+
+	s := Subject{UserId: &userId, Role: role}
+	switch role {
+	case "patient":
+		s.PatientId = &patientId
+	case "doctor":
+		s.DoctorId = &doctorId
+	}
+	return s
+}
+
+func TestDefaultRules(t *testing.T) {
+	for rule := range DefaultRules {
+		if _, ok := granted[rule]; !ok {
+			t.Errorf("DefaultRules grants %v, which is not expected", rule)
+		}
+	}
+
+	p := New(DefaultRules, fakeResolver{})
+
+	for _, role := range roles {
+		for _, action := range actions {
+			for _, resource := range resources {
+				access := granted[Rule{Role: role, Action: action, Resource: resource}]
+
+				tests := []struct {
+					target Target
+					allow  bool
+				}{
+					{Collection(resource), access != Denied},
+					{Instance(resource, ownedId), access != Denied},
+					{Instance(resource, foreignId), access == Any},
+					{Instance(resource, missingId), access == Any},
+				}
+
+				name := fmt.Sprintf("%s/%s/%s", role, action, resource)
+				t.Run(name, func(t *testing.T) {
+					subject := subject(role)
+
+					if got := p.Scope(subject, action, resource); got != access {
+						t.Errorf("Scope = %v, want %v", got, access)
+					}
+
+					for _, tt := range tests {
+						err := p.Authorize(context.Background(), subject, action, tt.target)
+						if tt.allow && err != nil {
+							t.Errorf("Authorize(%s) = %v, want allowed", describe(tt.target), err)
+						}
+						if !tt.allow && err != ErrForbidden {
+							t.Errorf("Authorize(%s) = %v, want ErrForbidden", describe(tt.target), err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestAuthorizeOwn(t *testing.T) {
+	var otherId = 99
+	p := New(DefaultRules, fakeResolver{})
+
+	tests := []struct {
+		name    string
+		subject Subject
+		target  Target
+		wantErr error
+	}{
+		{
+			name:    "patient without a patient id",
+			subject: Subject{Role: "patient"},
+			target:  Instance(Direction, ownedId),
+			wantErr: ErrForbidden,
+		},
+		{
+			name:    "doctor without a doctor id",
+			subject: Subject{Role: "doctor"},
+			target:  Instance(Direction, ownedId),
+			wantErr: ErrForbidden,
+		},
+		{
+			name:    "patient with the doctor's id",
+			subject: Subject{Role: "patient", PatientId: &otherId, DoctorId: intPtr(2)},
+			target:  Instance(Direction, ownedId),
+			wantErr: ErrForbidden,
+		},
+		{
+			name:    "doctor with the patient's id",
+			subject: Subject{Role: "doctor", PatientId: intPtr(1), DoctorId: &otherId},
+			target:  Instance(Analysis, ownedId),
+			wantErr: ErrForbidden,
+		},
+		{
+			name:    "resolver failure",
+			subject: subject("patient"),
+			target:  Instance(Direction, brokenId),
+			wantErr: errResolver,
+		},
+		{
+			name:    "resolver isn't asked for any access",
+			subject: subject("registrar"),
+			target:  Instance(Direction, brokenId),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Authorize(context.Background(), tt.subject, Read, tt.target)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Errorf("Authorize = %v, want allowed", err)
+			case tt.wantErr == ErrForbidden && err != ErrForbidden:
+				t.Errorf("Authorize = %v, want ErrForbidden", err)
+			case tt.wantErr == errResolver && (err == nil || err == ErrForbidden):
+				t.Errorf("Authorize = %v, want the resolver error", err)
+			}
+		})
+	}
+}
+
+func describe(target Target) string {
+	if target.Id == nil {
+		return string(target.Resource) + " collection"
+	}
+	return fmt.Sprintf("%s %d", target.Resource, *target.Id)
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/JulianaOsi/medhelp/pkg/policy"
+	"github.com/JulianaOsi/medhelp/pkg/store"
+)
+
+var access = policy.New(policy.DefaultRules, storeOwners{})
+
+// storeOwners resolves resource ownership for the policy from the database.
+type storeOwners struct{}
+
+func (storeOwners) Owner(ctx context.Context, resource policy.Resource, id int) (*policy.Owner, error) {
+	var owner *store.DirectionOwner
+	var err error
+
+	switch resource {
+	case policy.Direction:
+		owner, err = store.DB.GetDirectionOwner(ctx, id)
+	case policy.Analysis:
+		owner, err = store.DB.GetAnalysisOwner(ctx, id)
+	default:
+		return nil, nil
+	}
+	if err != nil || owner == nil {
+		return nil, err
+	}
+
+	return &policy.Owner{PatientId: owner.PatientId, DoctorId: owner.DoctorId}, nil
+}
+
+// authorize checks the request against the access policy. If the request is
+// not allowed it writes the response itself and returns false.
+func authorize(w http.ResponseWriter, r *http.Request, action policy.Action, target policy.Target) bool {
+	err := access.Authorize(r.Context(), claimsFromContext(r.Context()).Subject(), action, target)
+	if err == nil {
+		return true
+	}
+
+	if err != policy.ErrForbidden {
+		writeError(w, r, fmt.Errorf("failed to authorize request: %w", err))
+		return false
+	}
+
+	writeProblem(w, r, http.StatusForbidden, "forbidden", err.Error())
+	return false
+}
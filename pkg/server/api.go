@@ -1,1105 +1,639 @@
 package server
 
 import (
-	"bytes"
-	"context"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"path/filepath"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
-	"github.com/gorilla/mux"
-	"github.com/sirupsen/logrus"
-
 	"github.com/JulianaOsi/medhelp/pkg/config"
+	"github.com/JulianaOsi/medhelp/pkg/metrics"
+	"github.com/JulianaOsi/medhelp/pkg/policy"
 	"github.com/JulianaOsi/medhelp/pkg/store"
 )
 
-func addDirection(w http.ResponseWriter, r *http.Request) {
-	setupCorsResponse(&w) //CORS
-	type Direction struct {
-		Patient             store.NewPatient `json:"patient"`
-		Doctor              store.NewDoctor  `json:"doctor"`
-		Date                time.Time        `json:"date"`
-		IcdCode             string           `json:"icd_code"`
-		MedicalOrganization string           `json:"medical_organization"`
-		OrganizationContact string           `json:"organization_contact"`
-		Justification       string           `json:"justification"`
-	}
-	type directions struct {
-		Directions []Direction `json:"directions"`
-	}
+// Modes of a direction batch. In batchAllOrNothing the first failing entry
+// rejects the whole batch, in batchPerItem every entry succeeds or fails on
+// its own.
+const (
+	batchAllOrNothing = "all_or_nothing"
+	batchPerItem      = "per_item"
+)
 
-	type status struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}
-	type response struct {
-		Status status `json:"status"`
+// newDirection is one entry of the addDirection batch.
+type newDirection struct {
+	Patient             store.NewPatient `json:"patient"`
+	Doctor              store.NewDoctor  `json:"doctor"`
+	Date                time.Time        `json:"date"`
+	IcdCode             string           `json:"icd_code"`
+	MedicalOrganization string           `json:"medical_organization"`
+	OrganizationContact string           `json:"organization_contact"`
+	Justification       string           `json:"justification"`
+}
+
+func (d newDirection) entry() store.DirectionEntry {
+	return store.DirectionEntry{
+		Patient: d.Patient,
+		Doctor:  d.Doctor,
+		Direction: store.NewDirection{
+			Date:                d.Date,
+			IcdCode:             d.IcdCode,
+			MedicalOrganization: d.MedicalOrganization,
+			OrganizationContact: d.OrganizationContact,
+			Justification:       d.Justification,
+		},
 	}
+}
 
-	var resp response
-	resp.Status.Status = "ok"
+// directionResult is the outcome of one batch entry: the ids on success and
+// the problem otherwise.
+type directionResult struct {
+	*store.DirectionResult
+	Error *problem `json:"error,omitempty"`
+}
 
-	token, err := jwtMiddleware(r.Header.Get("Authorization"))
-	if err != nil {
-		logrus.Errorf("failed to parse token: %v\n", err)
-		resp.Status.Status = "error"
-		resp.Status.Message = err.Error()
-		respBytes, err := json.Marshal(resp)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to marshall response: %v\n", err)
-			return
-		}
+func addDirection(w http.ResponseWriter, r *http.Request) {
+	type directions struct {
+		Mode       string         `json:"mode"`
+		Directions []newDirection `json:"directions"`
+	}
 
-		if _, err := w.Write(respBytes); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to write response: %v\n", err)
-		}
+	if !authorize(w, r, policy.Create, policy.Collection(policy.Direction)) {
 		return
 	}
 
-	var claims = token.Claims.(jwt.MapClaims)
-	var isAccess = false
-
-	if claims["role"] == "registrar" {
-		isAccess = true
+	update := directions{Mode: batchAllOrNothing}
+	if !decodeJSON(w, r, &update) {
+		return
 	}
 
-	if isAccess == false {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Header().Set("WWW-Authenticate", "Bearer realm=\"Access to the direction\", charset=\"UTF-8\"")
-		return
+	var errs store.ValidationError
+	if update.Mode != batchAllOrNothing && update.Mode != batchPerItem {
+		errs.Add("mode", "must be all_or_nothing or per_item")
+	}
+	if len(update.Directions) == 0 {
+		errs.Add("directions", "must not be empty")
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to read body: %v\n", err)
+	var entries = make([]store.DirectionEntry, 0, len(update.Directions))
+	for i, j := range update.Directions {
+		entry := j.entry()
+		entry.Direction.CreatedBy = claimsFromContext(r.Context()).UserId
+		if update.Mode == batchAllOrNothing {
+			errs.Merge(fmt.Sprintf("directions[%d]", i), entry.Validate())
+		}
+		entries = append(entries, entry)
+	}
+	if err := errs.Err(); err != nil {
+		writeError(w, r, err)
 		return
 	}
-	update := directions{}
 
-	err = json.Unmarshal(body, &update)
+	results, err := store.DB.AddDirections(r.Context(), entries, update.Mode == batchAllOrNothing)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to unmarshal json: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to add directions: %w", err))
 		return
 	}
 
-	for _, j := range update.Directions {
-		patientId, err := store.DB.AddPatient(context.Background(), j.Patient)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to add patient: %v\n", err)
-			return
-		}
-
-		doctorId, err := store.DB.AddDoctor(context.Background(), j.Doctor)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to add doctor: %v\n", err)
-			return
-		}
-
-		direction := store.NewDirection{
-			PatientId:           *patientId,
-			DoctorId:            *doctorId,
-			Date:                j.Date,
-			IcdCode:             j.IcdCode,
-			MedicalOrganization: j.MedicalOrganization,
-			OrganizationContact: j.OrganizationContact,
-			Justification:       j.Justification,
-		}
-
-		err = store.DB.AddDirection(context.Background(), direction)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to add direction: %v\n", err)
-			return
+	var status = http.StatusCreated
+	var resp = make([]directionResult, 0, len(results))
+	for _, result := range results {
+		if result.Error != nil {
+			status = http.StatusOK
+			resp = append(resp, directionResult{Error: problemFor(r, result.Error)})
+			continue
 		}
+		resp = append(resp, directionResult{DirectionResult: result})
 	}
+
+	writeJSON(w, r, status, envelope{"directions": resp})
 }
 
 func getDirections(w http.ResponseWriter, r *http.Request) {
-	setupCorsResponse(&w) //CORS
-	type status struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}
-	type response struct {
-		Status     status             `json:"status"`
-		Directions []*store.Direction `json:"directions"`
+	if !authorize(w, r, policy.Read, policy.Collection(policy.Direction)) {
+		return
 	}
 
-	var resp response
-	resp.Status.Status = "ok"
+	var subject = claimsFromContext(r.Context()).Subject()
+	var directions []*store.Direction
+	var err error
 
-	token, err := jwtMiddleware(r.Header.Get("Authorization"))
-	if err != nil {
-		logrus.Errorf("failed to parse token: %v\n", err)
-		resp.Status.Status = "error"
-		resp.Status.Message = err.Error()
-		respBytes, err := json.Marshal(resp)
+	if access.Scope(subject, policy.Read, policy.Direction) == policy.Any {
+		directions, err = store.DB.GetDirections(r.Context())
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to marshall response: %v\n", err)
+			writeError(w, r, fmt.Errorf("failed to get directions: %w", err))
 			return
 		}
-
-		w.Header().Set("content-type", "application/json")
-		if _, err := w.Write(respBytes); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to write response: %v\n", err)
-		}
-		return
-	}
-
-	var claims = token.Claims.(jwt.MapClaims)
-
-	if claims["role"] == "patient" {
-		resp.Directions, err = store.DB.GetDirectionsByPatientId(context.Background(), fmt.Sprintf("%v", claims["patient_id"]))
+	} else if subject.PatientId != nil {
+		directions, err = store.DB.GetDirectionsByPatientId(r.Context(), strconv.Itoa(*subject.PatientId))
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to get directions by patient id: %v\n", err)
+			writeError(w, r, fmt.Errorf("failed to get directions by patient id: %w", err))
 			return
 		}
-	} else if claims["role"] == "registrar" {
-		resp.Directions, err = store.DB.GetDirections(context.Background())
+	} else if subject.DoctorId != nil {
+		directions, err = store.DB.GetDirectionsByDoctorId(r.Context(), strconv.Itoa(*subject.DoctorId))
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to get directions: %v\n", err)
+			writeError(w, r, fmt.Errorf("failed to get directions by doctor id: %w", err))
 			return
 		}
 	}
 
-	respBytes, err := json.Marshal(resp)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to marshall response: %v\n", err)
-		return
-	}
-
-	w.Header().Set("content-type", "application/json")
-	if _, err := w.Write(respBytes); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to write response: %v\n", err)
-	}
-	return
+	writeJSON(w, r, http.StatusOK, envelope{"directions": directions})
 }
 
 func getDirection(w http.ResponseWriter, r *http.Request) {
-	setupCorsResponse(&w) //CORS
-	type status struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}
-	type response struct {
-		Status    status           `json:"status"`
-		Direction *store.Direction `json:"direction"`
+	id, ok := pathId(w, r, "id")
+	if !ok {
+		return
 	}
 
-	var resp response
-	resp.Status.Status = "ok"
+	if !authorize(w, r, policy.Read, policy.Instance(policy.Direction, id)) {
+		return
+	}
 
-	token, err := jwtMiddleware(r.Header.Get("Authorization"))
+	direction, err := store.DB.GetDirectionById(r.Context(), id)
 	if err != nil {
-		logrus.Errorf("failed to parse token: %v\n", err)
-		resp.Status.Status = "error"
-		resp.Status.Message = err.Error()
-		respBytes, err := json.Marshal(resp)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to marshall response: %v\n", err)
-			return
-		}
-
-		w.Header().Set("content-type", "application/json")
-		if _, err := w.Write(respBytes); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to write response: %v\n", err)
-		}
+		writeError(w, r, fmt.Errorf("failed to get direction: %w", err))
 		return
 	}
 
-	var claims = token.Claims.(jwt.MapClaims)
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to convert string to int: %v\n", err)
+	if direction == nil {
+		writeProblem(w, r, http.StatusNotFound, "direction_not_found", "there is no such direction")
 		return
 	}
 
-	if claims["role"] == "patient" {
-		directions, err := store.DB.GetDirectionsByPatientId(context.Background(), fmt.Sprintf("%v", claims["patient_id"]))
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to get directions by patient id: %v\n", err)
-			return
-		}
+	writeJSON(w, r, http.StatusOK, envelope{"direction": direction})
+}
 
-		for _, j := range directions {
-			if j.Id == id {
-				resp.Direction = j
-			}
-		}
-	} else if claims["role"] == "registrar" {
-		resp.Direction, err = store.DB.GetDirectionById(context.Background(), id)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to get direction: %v\n", err)
-			return
-		}
+func getDirectionHistory(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r, "id")
+	if !ok {
+		return
 	}
 
-	if resp.Direction == nil {
-		resp.Status.Status = "info"
-		resp.Status.Message = "There is no such direction or you have no access"
+	if !authorize(w, r, policy.Read, policy.Instance(policy.Direction, id)) {
+		return
 	}
 
-	respBytes, err := json.Marshal(resp)
+	history, err := store.DB.GetDirectionStatusHistory(r.Context(), id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to marshall response: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to get direction status history: %w", err))
 		return
 	}
 
-	w.Header().Set("content-type", "application/json")
-	if _, err := w.Write(respBytes); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to write response: %v\n", err)
+	// Every direction has at least the status it was created with.
+	if len(history) == 0 {
+		writeProblem(w, r, http.StatusNotFound, "direction_not_found", "there is no such direction")
+		return
 	}
-	return
+
+	writeJSON(w, r, http.StatusOK, envelope{"history": history})
 }
 
 func getDirectionAnalysis(w http.ResponseWriter, r *http.Request) {
-	setupCorsResponse(&w) //CORS
-	type status struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}
-	type response struct {
-		Status   status            `json:"status"`
-		Analysis []*store.Analysis `json:"analysis"`
+	id, ok := pathId(w, r, "id")
+	if !ok {
+		return
 	}
 
-	var resp response
-	resp.Status.Status = "ok"
-
-	token, err := jwtMiddleware(r.Header.Get("Authorization"))
-	if err != nil {
-		logrus.Errorf("failed to parse token: %v\n", err)
-		resp.Status.Status = "error"
-		resp.Status.Message = err.Error()
-		respBytes, err := json.Marshal(resp)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to marshall response: %v\n", err)
-			return
-		}
-
-		w.Header().Set("content-type", "application/json")
-		if _, err := w.Write(respBytes); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to write response: %v\n", err)
-		}
+	if !authorize(w, r, policy.Read, policy.Instance(policy.Direction, id)) {
 		return
 	}
 
-	var claims = token.Claims.(jwt.MapClaims)
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
+	analysis, err := store.DB.GetAnalysisByDirectionId(r.Context(), id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to convert string to int: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to get analysis by direction id: %w", err))
 		return
 	}
 
-	if claims["role"] == "registrar" {
-		resp.Analysis, err = store.DB.GetAnalysisByDirectionId(context.Background(), id)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to get analysis by direction id: %v\n", err)
-			return
-		}
-	} else if claims["role"] == "patient" {
-		directions, err := store.DB.GetDirectionsByPatientId(context.Background(), fmt.Sprintf("%v", claims["patient_id"]))
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to get directions by patient id: %v\n", err)
-			return
-		}
+	writeJSON(w, r, http.StatusOK, envelope{"analysis": analysis})
+}
 
-		for i := range directions {
-			if directions[i].Id == id {
-				resp.Analysis, err = store.DB.GetAnalysisByDirectionId(context.Background(), id)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					logrus.Errorf("failed to get analysis by direction id: %v\n", err)
-					return
-				}
-			}
-		}
+func addDirectionAnalysis(w http.ResponseWriter, r *http.Request) {
+	type analysisAdd struct {
+		AnalysisId *int `json:"analysisId"`
 	}
 
-	if resp.Analysis == nil {
-		w.WriteHeader(http.StatusUnauthorized)
+	id, ok := pathId(w, r, "id")
+	if !ok {
 		return
 	}
 
-	respBytes, err := json.Marshal(resp)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to marshall response: %v\n", err)
+	if !authorize(w, r, policy.Update, policy.Instance(policy.Direction, id)) {
 		return
 	}
 
-	w.Header().Set("content-type", "application/json")
-	if _, err := w.Write(respBytes); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to write response: %v\n", err)
-	}
-	return
-}
-
-func setDirectionStatus(w http.ResponseWriter, r *http.Request) {
-	setupCorsResponse(&w) //CORS
-	type directionUpdate struct {
-		DirectionId int `json:"directionId"`
-		Status      int `json:"status"`
+	add := analysisAdd{}
+	if !decodeJSON(w, r, &add) {
+		return
 	}
 
-	type status struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}
-	type response struct {
-		Status status `json:"status"`
+	if add.AnalysisId == nil {
+		var errs store.ValidationError
+		errs.Add("analysisId", "is required")
+		writeError(w, r, errs.Err())
+		return
 	}
 
-	var resp response
-	resp.Status.Status = "ok"
-	token, err := jwtMiddleware(r.Header.Get("Authorization"))
+	analysis, err := store.DB.AddDirectionAnalysis(r.Context(), id, *add.AnalysisId, claimsFromContext(r.Context()).UserId)
 	if err != nil {
-		logrus.Errorf("failed to parse token: %v\n", err)
-		resp.Status.Status = "error"
-		resp.Status.Message = err.Error()
-		respBytes, err := json.Marshal(resp)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to marshall response: %v\n", err)
-			return
-		}
-
-		w.Header().Set("content-type", "application/json")
-		if _, err := w.Write(respBytes); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to write response: %v\n", err)
-		}
+		writeError(w, r, fmt.Errorf("failed to add direction analysis: %w", err))
 		return
 	}
 
-	var claims = token.Claims.(jwt.MapClaims)
-	var isAccess = false
+	writeJSON(w, r, http.StatusCreated, envelope{"analysis": analysis})
+}
 
-	if claims["role"] == "registrar" {
-		isAccess = true
+func removeDirectionAnalysis(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r, "analysis")
+	if !ok {
+		return
 	}
 
-	if isAccess == false {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Header().Set("WWW-Authenticate", "Bearer realm=\"Access to the direction\", charset=\"UTF-8\"")
+	if !authorize(w, r, policy.Delete, policy.Instance(policy.Analysis, id)) {
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	err := store.DB.RemoveDirectionAnalysis(r.Context(), id, claimsFromContext(r.Context()).UserId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to read body: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to remove direction analysis: %w", err))
 		return
 	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setDirectionStatus(w http.ResponseWriter, r *http.Request) {
+	type directionUpdate struct {
+		DirectionId int                   `json:"directionId"`
+		Status      store.DirectionStatus `json:"status"`
+		Reason      string                `json:"reason"`
+	}
+
 	update := directionUpdate{}
+	if !decodeJSON(w, r, &update) {
+		return
+	}
 
-	err = json.Unmarshal(body, &update)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to unmarshal json: %v\n", err)
+	if !authorize(w, r, policy.Update, policy.Instance(policy.Direction, update.DirectionId)) {
 		return
 	}
 
-	err = store.DB.SetDirectionStatus(context.Background(), update.DirectionId, update.Status)
+	err := store.DB.SetDirectionStatus(r.Context(), update.DirectionId, store.StatusChange{
+		Status:    update.Status,
+		ChangedBy: claimsFromContext(r.Context()).UserId,
+		Reason:    update.Reason,
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to set direction status: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to set direction status: %w", err))
 		return
 	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
+// setAnalysisCheck accepts an analysis or sends it back to pending. It
+// predates reviewAnalysis, which can also reject an analysis with a reason.
+// Like reviewAnalysis, it answers 409 once the direction is closed.
 func setAnalysisCheck(w http.ResponseWriter, r *http.Request) {
-	setupCorsResponse(&w) //CORS
 	type analysisUpdate struct {
 		AnalysisId int  `json:"analysisId"`
 		Checked    bool `json:"checked"`
 	}
 
-	type status struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
+	update := analysisUpdate{}
+	if !decodeJSON(w, r, &update) {
+		return
 	}
-	type response struct {
-		Status status `json:"status"`
+
+	if !authorize(w, r, policy.Review, policy.Instance(policy.Analysis, update.AnalysisId)) {
+		return
 	}
 
-	var resp response
-	resp.Status.Status = "ok"
-	token, err := jwtMiddleware(r.Header.Get("Authorization"))
-	if err != nil {
-		logrus.Errorf("failed to parse token: %v\n", err)
-		resp.Status.Status = "error"
-		resp.Status.Message = err.Error()
-		respBytes, err := json.Marshal(resp)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to marshall response: %v\n", err)
-			return
-		}
+	var review = store.AnalysisReview{
+		State:      store.ReviewPending,
+		ReviewedBy: claimsFromContext(r.Context()).UserId,
+	}
+	if update.Checked {
+		review.State = store.ReviewAccepted
+	}
 
-		w.Header().Set("content-type", "application/json")
-		if _, err := w.Write(respBytes); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to write response: %v\n", err)
-		}
+	err := store.DB.ReviewAnalysis(r.Context(), update.AnalysisId, review)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to review analysis: %w", err))
 		return
 	}
 
-	var claims = token.Claims.(jwt.MapClaims)
-	var isAccess = false
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	if claims["role"] == "registrar" {
-		isAccess = true
+func reviewAnalysis(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r, "analysis")
+	if !ok {
+		return
 	}
 
-	if isAccess == false {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Header().Set("WWW-Authenticate", "Bearer realm=\"Access to the analysis\", charset=\"UTF-8\"")
+	if !authorize(w, r, policy.Review, policy.Instance(policy.Analysis, id)) {
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to read body: %v\n", err)
+	review := store.AnalysisReview{}
+	if !decodeJSON(w, r, &review) {
 		return
 	}
-	update := analysisUpdate{}
+	review.ReviewedBy = claimsFromContext(r.Context()).UserId
 
-	err = json.Unmarshal(body, &update)
+	err := store.DB.ReviewAnalysis(r.Context(), id, review)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to unmarshal json: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to review analysis: %w", err))
 		return
 	}
 
-	err = store.DB.SetAnalysisState(context.Background(), update.AnalysisId, update.Checked)
+	analysis, err := store.DB.GetAnalysisById(r.Context(), id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to set analysis state: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to get analysis: %w", err))
 		return
 	}
+
+	writeJSON(w, r, http.StatusOK, envelope{"analysis": analysis})
 }
 
-func registrationHandler(w http.ResponseWriter, r *http.Request) {
-	setupCorsResponse(&w) //CORS
-	type registrar struct {
-		Secret string `json:"secret"`
-	}
-	type patient struct {
+// registrationForm registers either a patient, who is matched against the
+// patient table, or an invited user.
+type registrationForm struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Invite   *struct {
+		Code string `json:"code"`
+	} `json:"invite"`
+	Patient *struct {
 		Lastname     string `json:"lastname"`
 		PolicyNumber string `json:"policy_number"`
-	}
-	type form struct {
-		Username  string     `json:"username"`
-		Password  string     `json:"password"`
-		Registrar *registrar `json:"registrar"`
-		Patient   *patient   `json:"patient"`
-	}
+	} `json:"patient"`
+}
 
-	type status struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}
-	type response struct {
-		Status status `json:"status"`
-		Token  string `json:"token"`
+func (f registrationForm) Validate() error {
+	var errs store.ValidationError
+
+	store.ValidateCredentials(&errs, f.Username, f.Password)
+
+	switch {
+	case f.Invite == nil && f.Patient == nil:
+		errs.Add("invite", "either invite or patient is required")
+	case f.Invite != nil && f.Patient != nil:
+		errs.Add("invite", "must not be given together with patient")
+	case f.Invite != nil:
+		if f.Invite.Code == "" {
+			errs.Add("invite.code", "is required")
+		}
+	case f.Patient != nil:
+		if f.Patient.Lastname == "" {
+			errs.Add("patient.lastname", "is required")
+		}
+		if f.Patient.PolicyNumber == "" {
+			errs.Add("patient.policy_number", "is required")
+		}
 	}
 
-	cred := form{
-		Registrar: nil,
-		Patient:   nil,
+	return errs.Err()
+}
+
+func registrationHandler(w http.ResponseWriter, r *http.Request) {
+	cred := registrationForm{
+		Invite:  nil,
+		Patient: nil,
+	}
+	if !decodeJSON(w, r, &cred) {
+		return
 	}
 
-	var resp response
-	resp.Status.Status = "ok"
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to read body: %v\n", err)
+	if err := cred.Validate(); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	err = json.Unmarshal(body, &cred)
+	user, err := store.DB.GetUserByUsername(r.Context(), cred.Username)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("registrationHandler(): failed to unmarshal json: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to get user by username: %w", err))
 		return
 	}
 
-	user, err := store.DB.GetUserByUsername(context.Background(), cred.Username)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to get user by username: %v\n", err)
+	if user != nil {
+		writeProblem(w, r, http.StatusConflict, "username_taken", "user already exists")
 		return
 	}
 
-	if user == nil {
-		var claims = jwt.MapClaims{}
-		if cred.Registrar != nil {
-			if true { // TODO проверка на registrar secret, добавить информации в токен
-				err = store.DB.CreateUser(context.Background(), cred.Username, cred.Password, "registrar")
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					logrus.Errorf("failed to create user: %v\n", err)
-					return
-				}
-
-				claims = jwt.MapClaims{
-					"role":     "registrar",
-					"username": cred.Username,
-					"exp":      time.Now().Add(time.Hour * 24).Unix(),
-				}
-			}
-		} else if cred.Patient != nil {
-			existingPatient, err := store.DB.GetPatient(context.Background(), cred.Patient.Lastname, cred.Patient.PolicyNumber)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				logrus.Errorf("failed to get patient: %v\n", err)
-				return
-			}
-
-			if existingPatient == nil {
-				resp.Status.Status = "info"
-				resp.Status.Message = "There is no such patient"
-				respBytes, err := json.Marshal(resp)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					logrus.Errorf("failed to marshall response: %v\n", err)
-					return
-				}
-
-				w.Header().Set("content-type", "application/json")
-				if _, err := w.Write(respBytes); err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					logrus.Errorf("failed to write response: %v\n", err)
-				}
-				return
-			}
-
-			cond, err := store.DB.IsRelatedIdSet(context.Background(), existingPatient.Id)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				logrus.Errorf("failed to check related patient: %v\n", err)
-				return
-			}
-
-			if *cond {
-				resp.Status.Status = "info"
-				resp.Status.Message = "This patient already registered"
-				respBytes, err := json.Marshal(resp)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					logrus.Errorf("failed to marshall response: %v\n", err)
-					return
-				}
-
-				w.Header().Set("content-type", "application/json")
-				if _, err := w.Write(respBytes); err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					logrus.Errorf("failed to write response: %v\n", err)
-				}
-				return
-			}
-
-			err = store.DB.CreateUser(context.Background(), cred.Username, cred.Password, "patient")
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				logrus.Errorf("failed to create user: %v\n", err)
-				return
-			}
-
-			err = store.DB.AddRelatedIdToUser(context.Background(), cred.Username, existingPatient.Id)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				logrus.Errorf("failed to add related id to user: %v\n", err)
-				return
-			}
-
-			claims = jwt.MapClaims{
-				"role":       "patient",
-				"username":   cred.Username,
-				"patient_id": existingPatient.Id,
-				"exp":        time.Now().Add(time.Hour * 24).Unix(),
-			}
-		} else {
-			resp.Status.Status = "info"
-			resp.Status.Message = "Need more info in request"
-			respBytes, err := json.Marshal(resp)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				logrus.Errorf("failed to marshall response: %v\n", err)
-				return
-			}
-
-			w.Header().Set("content-type", "application/json")
-			if _, err := w.Write(respBytes); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				logrus.Errorf("failed to write response: %v\n", err)
-			}
+	if cred.Invite != nil {
+		_, err := store.DB.RegisterWithInvite(r.Context(), cred.Invite.Code, cred.Username, cred.Password, r.RemoteAddr)
+		if err != nil {
+			writeError(w, r, fmt.Errorf("failed to register with invite: %w", err))
+			return
+		}
+	} else if cred.Patient != nil {
+		existingPatient, err := store.DB.GetPatient(r.Context(), cred.Patient.Lastname, cred.Patient.PolicyNumber)
+		if err != nil {
+			writeError(w, r, fmt.Errorf("failed to get patient: %w", err))
+			return
+		}
+
+		if existingPatient == nil {
+			writeProblem(w, r, http.StatusNotFound, "patient_not_found", "there is no such patient")
 			return
 		}
 
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		resp.Token, err = token.SignedString(config.SigningKey)
+		cond, err := store.DB.IsRelatedIdSet(r.Context(), existingPatient.Id)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to sign JWT: %v\n", err)
+			writeError(w, r, fmt.Errorf("failed to check related patient: %w", err))
 			return
 		}
 
-		respBytes, err := json.Marshal(resp)
+		if *cond {
+			writeProblem(w, r, http.StatusConflict, "patient_already_registered", "this patient is already registered")
+			return
+		}
+
+		err = store.DB.CreateUser(r.Context(), cred.Username, cred.Password, "patient")
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to marshall response: %v\n", err)
+			writeError(w, r, fmt.Errorf("failed to create user: %w", err))
 			return
 		}
 
-		w.Header().Set("content-type", "application/json")
-		if _, err := w.Write(respBytes); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to write response: %v\n", err)
+		err = store.DB.AddRelatedIdToUser(r.Context(), cred.Username, existingPatient.Id)
+		if err != nil {
+			writeError(w, r, fmt.Errorf("failed to add related id to user: %w", err))
+			return
 		}
-		return
 	}
-	resp.Status.Status = "info"
-	resp.Status.Message = "User already exists"
-	respBytes, err := json.Marshal(resp)
+
+	newUser, err := store.DB.GetUserByUsername(r.Context(), cred.Username)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to marshall response: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to get user by username: %w", err))
 		return
 	}
 
-	w.Header().Set("content-type", "application/json")
-	if _, err := w.Write(respBytes); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to write response: %v\n", err)
+	resp, err := issueTokens(r.Context(), newUser)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to issue tokens: %w", err))
+		return
 	}
-	return
+
+	writeJSON(w, r, http.StatusCreated, resp)
 }
 
 func authenticationHandler(w http.ResponseWriter, r *http.Request) {
-	setupCorsResponse(&w) //CORS
 	type form struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	}
 
-	type status struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}
-	type response struct {
-		Status status `json:"status"`
-		Token  string `json:"token"`
-	}
-
 	cred := form{}
-	var resp response
-	resp.Status.Status = "ok"
-
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to read body: %v\n", err)
-		return
-	}
-
-	err = json.Unmarshal(body, &cred)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to unmarshall json: %v\n", err)
+	if !decodeJSON(w, r, &cred) {
 		return
 	}
 
-	user, err := store.DB.GetUserByUsername(context.Background(), cred.Username)
+	user, err := store.DB.GetUserByUsername(r.Context(), cred.Username)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to get user by username: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to get user by username: %w", err))
 		return
 	}
 
 	if user == nil {
-		resp.Status.Status = "info"
-		resp.Status.Message = "User or password not found"
-		respBytes, err := json.Marshal(resp)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to marshall response: %v\n", err)
-			return
-		}
-
-		w.Header().Set("content-type", "application/json")
-		if _, err := w.Write(respBytes); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to write response: %v\n", err)
-		}
+		writeProblem(w, r, http.StatusUnauthorized, "invalid_credentials", "user or password not found")
 		return
 	}
 
-	cond, err := store.DB.IsPasswordCorrect(context.Background(), cred.Username, cred.Password)
+	cond, err := store.DB.IsPasswordCorrect(r.Context(), cred.Username, cred.Password)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to check password: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to check password: %w", err))
 		return
 	}
 
-	if *cond {
-		var claims = jwt.MapClaims{}
-		if user.Role == "registrar" {
-			claims = jwt.MapClaims{
-				"role":     "registrar",
-				"username": user.Username,
-				"exp":      time.Now().Add(time.Hour * 24).Unix(),
-			}
-		}
-		if user.Role == "patient" {
-			claims = jwt.MapClaims{
-				"role":       "patient",
-				"username":   user.Username,
-				"patient_id": user.RelatedId,
-				"exp":        time.Now().Add(time.Hour * 24).Unix(),
-			}
-
-		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		resp.Token, err = token.SignedString(config.SigningKey)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to sign JWT: %v\n", err)
-			return
-		}
-
-		respBytes, err := json.Marshal(resp)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to marshall response: %v\n", err)
-			return
-		}
-
-		w.Header().Set("content-type", "application/json")
-		if _, err := w.Write(respBytes); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to write response: %v\n", err)
-		}
-		return
-	}
-	resp.Status.Status = "info"
-	resp.Status.Message = "User or password not found"
-	respBytes, err := json.Marshal(resp)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to marshall response: %v\n", err)
+	if !*cond {
+		writeProblem(w, r, http.StatusUnauthorized, "invalid_credentials", "user or password not found")
 		return
 	}
 
-	w.Header().Set("content-type", "application/json")
-	if _, err := w.Write(respBytes); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to write response: %v\n", err)
-	}
-	return
-}
-
-func jwtMiddleware(tokenString string) (*jwt.Token, error) {
-	tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return config.SigningKey, nil
-	})
+	resp, err := issueTokens(r.Context(), user)
 	if err != nil {
-		logrus.Errorf("failed to parse token: %v\n", err)
-		return nil, err
+		writeError(w, r, fmt.Errorf("failed to issue tokens: %w", err))
+		return
 	}
 
-	return token, nil
-}
-
-func corsSkip(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-	return
-}
-
-func setupCorsResponse(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Authorization")
+	writeJSON(w, r, http.StatusOK, resp)
 }
 
 func uploadAnalysisFile(w http.ResponseWriter, r *http.Request) {
-	setupCorsResponse(&w) //CORS
-	type status struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}
-	type response struct {
-		Status status `json:"status"`
-	}
-
-	var resp response
-	resp.Status.Status = "ok"
-	token, err := jwtMiddleware(r.Header.Get("Authorization"))
-	if err != nil {
-		logrus.Errorf("failed to parse token: %v\n", err)
-		resp.Status.Status = "error"
-		resp.Status.Message = err.Error()
-		respBytes, err := json.Marshal(resp)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to marshall response: %v\n", err)
-			return
-		}
-
-		w.Header().Set("content-type", "application/json")
-		if _, err := w.Write(respBytes); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to write response: %v\n", err)
-		}
+	analysisId, ok := pathId(w, r, "analysis")
+	if !ok {
 		return
 	}
 
-	vars := mux.Vars(r)
-	analysisId, err := strconv.Atoi(vars["analysis"])
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to convert string to int: %v\n", err)
+	if !authorize(w, r, policy.Upload, policy.Instance(policy.Analysis, analysisId)) {
 		return
 	}
 
-	var claims = token.Claims.(jwt.MapClaims)
-	var isAccess = false
+	// The file is streamed to the storage straight from the request, so the
+	// body is capped a little above the file limit to leave room for the
+	// multipart headers.
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadSize+1<<20)
 
-	if claims["role"] == "patient" {
-		directions, err := store.DB.GetDirectionsByPatientId(context.Background(), fmt.Sprintf("%v", claims["patient_id"]))
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to get directions by patient id: %v\n", err)
-			return
-		}
-
-		for _, j := range directions {
-			analysis, err := store.DB.GetAnalysisByDirectionId(context.Background(), j.Id)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				logrus.Errorf("failed to get analysis by direction id: %v\n", err)
-				return
-			}
-
-			for _, n := range analysis {
-				if n.Id == analysisId {
-					isAccess = true
-				}
-			}
-		}
-	}
-
-	if claims["role"] == "registrar" {
-		isAccess = true
-	}
-
-	if isAccess == false {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Header().Set("WWW-Authenticate", "Bearer realm=\"Access to the patient analysis\", charset=\"UTF-8\"")
-		return
-	}
-
-	file, handler, err := r.FormFile("file")
+	file, err := uploadedFile(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to get file: %v\n", err)
+		writeProblem(w, r, http.StatusBadRequest, "file_missing", fmt.Sprintf("failed to get file: %v", err))
 		return
 	}
 	defer file.Close()
 
-	fileId, err := store.DB.SaveFile(context.Background(), file, handler.Filename)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to save analysis file: %v\n", err)
+	limit := &uploadLimit{r: file, max: config.MaxUploadSize}
+	content, contentType, err := sniffUpload(limit)
+	if limit.exceeded {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "file_too_large",
+			fmt.Sprintf("files larger than %d bytes are not accepted", config.MaxUploadSize))
 		return
 	}
-
-	err = store.DB.SetAnalysisFile(context.Background(), analysisId, *fileId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to set analysis file: %v\n", err)
+		writeProblem(w, r, http.StatusBadRequest, "file_missing", fmt.Sprintf("failed to read file: %v", err))
 		return
 	}
-
-	analysis, err := store.DB.GetAnalysisById(context.Background(), analysisId)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to get analysis: %v\n", err)
+	if contentType == "" {
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "unsupported_file_type",
+			"only PDF, JPEG, PNG and DICOM files are accepted")
 		return
 	}
 
-	err = store.DB.SetDirectionStatus(context.Background(), analysis.DirectionId, 1)
+	_, err = store.DB.SaveAnalysisFile(r.Context(), analysisId, store.NewFile{
+		Content:      content,
+		OriginalName: file.FileName(),
+		Size:         -1,
+		ContentType:  contentType,
+	}, claimsFromContext(r.Context()).UserId)
+	if limit.exceeded {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "file_too_large",
+			fmt.Sprintf("files larger than %d bytes are not accepted", config.MaxUploadSize))
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to set direction status: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to save analysis file: %w", err))
 		return
 	}
 
-	return
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func downloadAnalysisFile(w http.ResponseWriter, r *http.Request) {
-	setupCorsResponse(&w) //CORS
-	type status struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}
-	type response struct {
-		Status status `json:"status"`
-	}
-
-	var resp response
-	resp.Status.Status = "ok"
-	token, err := jwtMiddleware(r.Header.Get("Authorization"))
-	if err != nil {
-		logrus.Errorf("failed to parse token: %v\n", err)
-		resp.Status.Status = "error"
-		resp.Status.Message = err.Error()
-		respBytes, err := json.Marshal(resp)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to marshall response: %v\n", err)
-			return
-		}
-
-		w.Header().Set("content-type", "application/json")
-		if _, err := w.Write(respBytes); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to write response: %v\n", err)
-		}
+	analysisId, ok := pathId(w, r, "analysis")
+	if !ok {
 		return
 	}
 
-	vars := mux.Vars(r)
-	analysisId, err := strconv.Atoi(vars["analysis"])
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to convert string to int: %v\n", err)
-		return
-	}
-
-	var claims = token.Claims.(jwt.MapClaims)
-	var isAccess = false
-
-	if claims["role"] == "patient" {
-		directions, err := store.DB.GetDirectionsByPatientId(context.Background(), fmt.Sprintf("%v", claims["patient_id"]))
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to get directions by patient id: %v\n", err)
-			return
-		}
-
-		for _, j := range directions {
-			analysis, err := store.DB.GetAnalysisByDirectionId(context.Background(), j.Id)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				logrus.Errorf("failed to get analysis by direction id: %v\n", err)
-				return
-			}
-
-			for _, n := range analysis {
-				if n.Id == analysisId {
-					isAccess = true
-				}
-			}
-		}
-	}
-
-	if claims["role"] == "registrar" {
-		isAccess = true
-	}
-
-	if isAccess == false {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Header().Set("WWW-Authenticate", "Bearer realm=\"Access to the patient analysis\", charset=\"UTF-8\"")
+	if !authorize(w, r, policy.Read, policy.Instance(policy.Analysis, analysisId)) {
 		return
 	}
 
-	analysis, err := store.DB.GetAnalysisById(context.Background(), analysisId)
+	analysis, err := store.DB.GetAnalysisById(r.Context(), analysisId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to get analysis by id: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to get analysis by id: %w", err))
 		return
 	}
 
 	if analysis == nil {
-		w.WriteHeader(http.StatusNoContent)
+		writeProblem(w, r, http.StatusNotFound, "analysis_not_found", "there is no such analysis")
 		return
 	}
 
 	if analysis.FileId == nil {
-		w.WriteHeader(http.StatusNoContent)
+		writeProblem(w, r, http.StatusNotFound, "file_not_found", "no file has been uploaded for this analysis")
 		return
 	}
 
-	filePath, err := store.DB.GetFilepath(context.Background(), *analysis.FileId)
+	content, file, err := store.DB.OpenFile(r.Context(), *analysis.FileId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Errorf("failed to get filepath: %v\n", err)
+		writeError(w, r, fmt.Errorf("failed to open file: %w", err))
 		return
 	}
+	defer content.Close()
 
-	if filePath != nil {
-		streamBytes, err := ioutil.ReadFile(*filePath)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to read file: %v\n", err)
-			return
-		}
-		ext := filepath.Ext(*filePath)
-		b := bytes.NewBuffer(streamBytes)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", analysis.Name+ext))
-		w.Header().Set("Content-Type", "multipart/form-data")
-
-		_, err = w.Write(b.Bytes())
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			logrus.Errorf("failed to response with file: %v\n", err)
-			return
-		}
-		return
+	contentType := analysis.FileContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(analysis.Name+downloadExt(analysis.FileContentType, analysis.FileName)))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Analysis files must not be kept by shared caches, and clients have to
+	// revalidate their copy, which costs a 304 while the file is unchanged.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if file.Sha256 != nil {
+		w.Header().Set("ETag", `"`+*file.Sha256+`"`)
 	}
 
-	w.WriteHeader(http.StatusNoContent)
-	return
+	// ServeContent answers HEAD, Range, If-Range, If-None-Match and
+	// If-Modified-Since requests and sets Content-Length.
+	counter := &byteCounter{ResponseWriter: w, status: http.StatusOK}
+	http.ServeContent(counter, r, "", file.CreatedAt, content)
+
+	metrics.FilesDownloadedBytes.Add(float64(counter.written))
+	if r.Method == http.MethodGet && (counter.status == http.StatusOK || counter.status == http.StatusPartialContent) {
+		metrics.FilesDownloaded.Inc()
+	}
 }
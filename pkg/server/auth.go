@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/JulianaOsi/medhelp/pkg/config"
+	"github.com/JulianaOsi/medhelp/pkg/store"
+)
+
+// tokens is the response of every endpoint that logs a user in.
+type tokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// issueTokens opens a new session for the user and returns a signed access
+// token together with the session's first refresh token.
+func issueTokens(ctx context.Context, user *store.User) (*tokens, error) {
+	session, err := store.DB.CreateSession(ctx, *user.Id, time.Now().Add(config.RefreshTokenLifetime))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+
+	accessToken, err := signAccessToken(user, session.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokens{Token: accessToken, RefreshToken: session.RefreshToken}, nil
+}
+
+func signAccessToken(user *store.User, sessionId string) (string, error) {
+	var claims = Claims{
+		Role:      user.Role,
+		Username:  user.Username,
+		UserId:    user.Id,
+		SessionId: sessionId,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(config.AccessTokenLifetime).Unix(),
+		},
+	}
+	if user.Role == "patient" {
+		claims.PatientId = user.RelatedId
+	}
+	if user.Role == "doctor" {
+		claims.DoctorId = user.RelatedId
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString(config.SigningKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign JWT: %v", err)
+	}
+	return signed, nil
+}
+
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	type form struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	cred := form{}
+	if !decodeJSON(w, r, &cred) {
+		return
+	}
+
+	session, err := store.DB.RotateRefreshToken(r.Context(), cred.RefreshToken, time.Now().Add(config.RefreshTokenLifetime))
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to rotate refresh token: %w", err))
+		return
+	}
+
+	if session == nil {
+		writeProblem(w, r, http.StatusUnauthorized, "refresh_token_invalid", "refresh token is invalid or expired")
+		return
+	}
+
+	user, err := store.DB.GetUserById(r.Context(), session.UserId)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to get user by id: %w", err))
+		return
+	}
+
+	// The user has been deleted since the session started.
+	if user == nil {
+		if err := store.DB.RevokeSession(r.Context(), session.Id); err != nil {
+			writeError(w, r, fmt.Errorf("failed to revoke session: %w", err))
+			return
+		}
+		writeProblem(w, r, http.StatusUnauthorized, "refresh_token_invalid", "refresh token is invalid or expired")
+		return
+	}
+
+	accessToken, err := signAccessToken(user, session.Id)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to issue access token: %w", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, tokens{Token: accessToken, RefreshToken: session.RefreshToken})
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	err := store.DB.RevokeSession(r.Context(), claimsFromContext(r.Context()).SessionId)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to revoke session: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/JulianaOsi/medhelp/pkg/policy"
+	"github.com/JulianaOsi/medhelp/pkg/store"
+)
+
+func getCatalogAnalyses(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, policy.Read, policy.Collection(policy.Catalog)) {
+		return
+	}
+
+	analyses, err := store.DB.GetCatalogAnalyses(r.Context())
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to get analyses: %w", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, envelope{"analyses": analyses})
+}
+
+func getCatalogAnalysis(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r, "id")
+	if !ok {
+		return
+	}
+
+	if !authorize(w, r, policy.Read, policy.Instance(policy.Catalog, id)) {
+		return
+	}
+
+	analysis, err := store.DB.GetCatalogAnalysis(r.Context(), id)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to get analysis: %w", err))
+		return
+	}
+
+	if analysis == nil {
+		writeProblem(w, r, http.StatusNotFound, "analysis_not_found", "there is no such analysis")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, envelope{"analysis": analysis})
+}
+
+func addCatalogAnalysis(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, policy.Create, policy.Collection(policy.Catalog)) {
+		return
+	}
+
+	analysis := store.NewCatalogAnalysis{}
+	if !decodeJSON(w, r, &analysis) {
+		return
+	}
+
+	created, err := store.DB.CreateCatalogAnalysis(r.Context(), analysis)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to create analysis: %w", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusCreated, envelope{"analysis": created})
+}
+
+func updateCatalogAnalysis(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r, "id")
+	if !ok {
+		return
+	}
+
+	if !authorize(w, r, policy.Update, policy.Instance(policy.Catalog, id)) {
+		return
+	}
+
+	analysis := store.NewCatalogAnalysis{}
+	if !decodeJSON(w, r, &analysis) {
+		return
+	}
+
+	updated, err := store.DB.UpdateCatalogAnalysis(r.Context(), id, analysis)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to update analysis: %w", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, envelope{"analysis": updated})
+}
+
+func removeCatalogAnalysis(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r, "id")
+	if !ok {
+		return
+	}
+
+	if !authorize(w, r, policy.Delete, policy.Instance(policy.Catalog, id)) {
+		return
+	}
+
+	err := store.DB.DeleteCatalogAnalysis(r.Context(), id)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to delete analysis: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getIcdRules lists the current ICD rules, or the ones in effect at the time
+// given by the "at" query parameter in RFC 3339 format.
+func getIcdRules(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, policy.Read, policy.Collection(policy.Catalog)) {
+		return
+	}
+
+	var at = time.Now()
+	if value := r.URL.Query().Get("at"); value != "" {
+		var err error
+		at, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "invalid_time", "at must be an RFC 3339 time")
+			return
+		}
+	}
+
+	rules, err := store.DB.GetIcdRules(r.Context(), at)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to get icd rules: %w", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, envelope{"rules": rules})
+}
+
+func addIcdRule(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, policy.Create, policy.Collection(policy.Catalog)) {
+		return
+	}
+
+	rule := store.NewIcdRule{}
+	if !decodeJSON(w, r, &rule) {
+		return
+	}
+
+	created, err := store.DB.CreateIcdRule(r.Context(), rule, claimsFromContext(r.Context()).UserId)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to create icd rule: %w", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusCreated, envelope{"rule": created})
+}
+
+func updateIcdRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r, "id")
+	if !ok {
+		return
+	}
+
+	if !authorize(w, r, policy.Update, policy.Collection(policy.Catalog)) {
+		return
+	}
+
+	rule := store.NewIcdRule{}
+	if !decodeJSON(w, r, &rule) {
+		return
+	}
+
+	created, err := store.DB.UpdateIcdRule(r.Context(), id, rule, claimsFromContext(r.Context()).UserId)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to update icd rule: %w", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusCreated, envelope{"rule": created})
+}
+
+func removeIcdRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r, "id")
+	if !ok {
+		return
+	}
+
+	if !authorize(w, r, policy.Delete, policy.Collection(policy.Catalog)) {
+		return
+	}
+
+	err := store.DB.DeleteIcdRule(r.Context(), id)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to delete icd rule: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Limits of the number of codes returned by searchIcd10.
+const (
+	defaultIcdSearchLimit = 20
+	maxIcdSearchLimit     = 100
+)
+
+// searchIcd10 autocompletes an ICD-10 code by the beginning of the code or a
+// part of its title.
+func searchIcd10(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, policy.Read, policy.Collection(policy.Catalog)) {
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		writeError(w, r, &store.ValidationError{Fields: []store.FieldError{{Field: "q", Message: "is required"}}})
+		return
+	}
+
+	var limit = defaultIcdSearchLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxIcdSearchLimit {
+			writeProblem(w, r, http.StatusBadRequest, "invalid_limit", "limit must be a number from 1 to 100")
+			return
+		}
+	}
+
+	codes, err := store.DB.SearchIcd10(r.Context(), query, limit)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to search icd10: %w", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, envelope{"codes": codes})
+}
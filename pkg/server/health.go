@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/JulianaOsi/medhelp/pkg/store"
+	"github.com/JulianaOsi/medhelp/pkg/version"
+)
+
+// healthHandler reports that the process is up and serving requests. It
+// deliberately doesn't touch the database.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, envelope{"status": "ok"})
+}
+
+// readyHandler reports whether the dependencies needed to serve requests are
+// reachable. It answers 503 if any check fails. The endpoint needs no login,
+// so the reasons are only logged.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	type check struct {
+		Status string `json:"status"`
+	}
+	type response struct {
+		Status           string           `json:"status"`
+		Checks           map[string]check `json:"checks"`
+		MigrationVersion *int64           `json:"migration_version"`
+	}
+
+	var resp = response{Status: "ok", Checks: map[string]check{}}
+	var code = http.StatusOK
+
+	report := func(name string, err error) {
+		if err != nil {
+			logger(r).Errorf("readiness check %s failed: %v", name, err)
+			resp.Checks[name] = check{Status: "error"}
+			resp.Status = "error"
+			code = http.StatusServiceUnavailable
+			return
+		}
+		resp.Checks[name] = check{Status: "ok"}
+	}
+
+	report("database", store.DB.Ping(r.Context()))
+	report("files", store.DB.CheckFileStorage(r.Context()))
+
+	var err error
+	resp.MigrationVersion, err = store.DB.GetMigrationVersion(r.Context())
+	report("migrations", err)
+
+	writeJSON(w, r, code, resp)
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, version.Get())
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/JulianaOsi/medhelp/pkg/config"
+	"github.com/JulianaOsi/medhelp/pkg/policy"
+	"github.com/JulianaOsi/medhelp/pkg/store"
+)
+
+func addInvite(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, policy.Create, policy.Collection(policy.Invite)) {
+		return
+	}
+
+	invite := store.NewInvite{}
+	if !decodeJSON(w, r, &invite) {
+		return
+	}
+
+	if invite.Organization == "" {
+		writeError(w, r, &store.ValidationError{Fields: []store.FieldError{{Field: "organization", Message: "is required"}}})
+		return
+	}
+
+	if invite.Role == "doctor" && invite.DoctorId != nil {
+		doctor, err := store.DB.GetDoctorById(r.Context(), *invite.DoctorId)
+		if err != nil {
+			writeError(w, r, fmt.Errorf("failed to get doctor: %w", err))
+			return
+		}
+
+		if doctor == nil {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "doctor_not_found", "there is no such doctor")
+			return
+		}
+	} else if invite.Role != "doctor" {
+		invite.DoctorId = nil
+	}
+
+	if invite.ExpiresAt.IsZero() {
+		invite.ExpiresAt = time.Now().Add(config.InviteLifetime)
+	}
+
+	created, err := store.DB.CreateInvite(r.Context(), invite, claimsFromContext(r.Context()).UserId)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to create invite: %w", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusCreated, envelope{"invite": created})
+}
+
+func getInvites(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, policy.Read, policy.Collection(policy.Invite)) {
+		return
+	}
+
+	invites, err := store.DB.GetInvites(r.Context())
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to get invites: %w", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, envelope{"invites": invites})
+}
+
+func revokeInvite(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(w, r, "id")
+	if !ok {
+		return
+	}
+
+	if !authorize(w, r, policy.Delete, policy.Instance(policy.Invite, id)) {
+		return
+	}
+
+	err := store.DB.RevokeInvite(r.Context(), id)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to revoke invite: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/JulianaOsi/medhelp/pkg/config"
+	"github.com/JulianaOsi/medhelp/pkg/logging"
+	"github.com/JulianaOsi/medhelp/pkg/metrics"
+	"github.com/JulianaOsi/medhelp/pkg/policy"
+	"github.com/JulianaOsi/medhelp/pkg/store"
+)
+
+type contextKey int
+
+const claimsKey contextKey = iota
+
+// Claims is the payload of an access token.
+type Claims struct {
+	Role      string `json:"role"`
+	Username  string `json:"username"`
+	UserId    *int   `json:"user_id"`
+	PatientId *int   `json:"patient_id,omitempty"`
+	DoctorId  *int   `json:"doctor_id,omitempty"`
+	SessionId string `json:"sid"`
+	jwt.StandardClaims
+}
+
+func (c *Claims) Subject() policy.Subject {
+	return policy.Subject{
+		UserId:    c.UserId,
+		Role:      c.Role,
+		PatientId: c.PatientId,
+		DoctorId:  c.DoctorId,
+	}
+}
+
+// claimsFromContext returns the claims stored by authMiddleware. It is only
+// valid in handlers registered behind that middleware.
+func claimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey).(*Claims)
+	return claims
+}
+
+// authMiddleware rejects requests without a valid access token bound to an
+// active session and puts the token claims into the request context.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := parseToken(r.Context(), r.Header.Get("Authorization"))
+		if err != nil {
+			logger(r).Errorf("failed to parse token: %v\n", err)
+			writeProblem(w, r, http.StatusUnauthorized, "unauthorized", err.Error())
+			return
+		}
+
+		var fields = logrus.Fields{"role": claims.Role}
+		if claims.UserId != nil {
+			fields["user_id"] = *claims.UserId
+		}
+		logging.AddFields(r.Context(), fields)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
+	})
+}
+
+func parseToken(ctx context.Context, header string) (*Claims, error) {
+	ctx, span := tracer.Start(ctx, "auth.parseToken")
+	defer span.End()
+
+	tokenString := strings.TrimPrefix(header, "Bearer ")
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return config.SigningKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.SessionId == "" {
+		return nil, errors.New("token is not bound to a session")
+	}
+
+	active, err := store.DB.IsSessionActive(ctx, claims.SessionId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check session: %v", err)
+	}
+	if !*active {
+		return nil, errors.New("session has been ended")
+	}
+
+	return claims, nil
+}
+
+// corsMiddleware adds CORS headers for the allowed origins and answers every
+// preflight request itself, so routes don't need OPTIONS handlers. An origin
+// of "*" allows any origin.
+func corsMiddleware(origins []string) func(http.Handler) http.Handler {
+	var allowAny = false
+	var allowed = map[string]bool{}
+	for _, origin := range origins {
+		if origin == "*" {
+			allowAny = true
+		}
+		allowed[origin] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin != "" && (allowAny || allowed[origin]) {
+				if allowAny {
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+				} else {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Add("Vary", "Origin")
+				}
+				w.Header().Set("Access-Control-Allow-Methods", "POST, GET, HEAD, OPTIONS, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, "+
+					"Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+				w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, "+
+					"Upload-Offset, Upload-Length, Upload-Expires")
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// recoveryMiddleware turns a panic in a handler into a 500 response instead
+// of dropping the connection, and records it on the span of the request.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				logger(r).Errorf("panic while serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+				trace.SpanFromContext(r.Context()).RecordError(fmt.Errorf("panic: %v", err),
+					trace.WithAttributes(semconv.ExceptionStacktraceKey.String(string(debug.Stack()))))
+				writeProblem(w, r, http.StatusInternalServerError, "internal_error", "")
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loggingMiddleware gives every request an id, taken from a well-formed
+// X-Request-ID header or generated, starts the request's log scope and writes
+// one access log line when the request is done.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = logging.NewRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		ctx := logging.NewContext(r.Context(), requestID)
+		logging.AddFields(ctx, logrus.Fields{"method": r.Method, "path": r.URL.Path})
+
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		logging.FromContext(ctx).WithFields(logrus.Fields{
+			"status":   recorder.status,
+			"duration": time.Since(start),
+		}).Info("request served")
+	})
+}
+
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// logger returns the log entry of the request.
+func logger(r *http.Request) *logrus.Entry {
+	return logging.FromContext(r.Context())
+}
+
+// metricsMiddleware records request counts and latency per route. It has to be
+// installed with Router.Use so the matched route template is known.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		route := routeTemplate(r)
+		logging.AddFields(r.Context(), logrus.Fields{"route": route})
+
+		next.ServeHTTP(recorder, r)
+
+		metrics.HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		metrics.HTTPDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// tracingMiddleware starts a span for every routed request, continuing the
+// trace of the caller if the request carries one.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		route := routeTemplate(r)
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("medhelp", route, r)...),
+			trace.WithAttributes(attribute.String("medhelp.request_id", logging.RequestID(ctx))),
+		)
+		defer span.End()
+
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(recorder.status))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(recorder.status))
+	})
+}
+
+// routeTemplate returns the template of the matched mux route, such as
+// /direction/{id}, falling back to the request path.
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+var tracer = otel.Tracer("github.com/JulianaOsi/medhelp/pkg/server")
+
+// statusRecorder remembers the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
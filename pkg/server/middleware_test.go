@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/JulianaOsi/medhelp/pkg/metrics"
+)
+
+func TestPanicIsCountedAndTraced(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	r := mux.NewRouter()
+	r.Use(metricsMiddleware, tracingMiddleware, recoveryMiddleware)
+	r.HandleFunc("/panic/{id}", func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	})
+
+	counter := metrics.HTTPRequests.WithLabelValues("/panic/{id}", http.MethodGet, "500")
+	before := testutil.ToFloat64(counter)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic/1", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("%v requests counted as 500, want 1", got)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans ended, want 1", len(spans))
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("span status = %v, want an error", spans[0].Status())
+	}
+
+	var recorded bool
+	for _, event := range spans[0].Events() {
+		recorded = recorded || event.Name == "exception"
+	}
+	if !recorded {
+		t.Errorf("the panic isn't recorded on the span")
+	}
+}
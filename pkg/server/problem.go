@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/JulianaOsi/medhelp/pkg/logging"
+	"github.com/JulianaOsi/medhelp/pkg/store"
+)
+
+// problem is an RFC 7807 error response. Code is a stable, machine-readable
+// identifier of the error, e.g. "direction_not_found".
+type problem struct {
+	Type      string             `json:"type"`
+	Title     string             `json:"title"`
+	Status    int                `json:"status"`
+	Detail    string             `json:"detail,omitempty"`
+	Instance  string             `json:"instance,omitempty"`
+	Code      string             `json:"code"`
+	RequestId string             `json:"request_id,omitempty"`
+	Errors    []store.FieldError `json:"errors,omitempty"`
+}
+
+func newProblem(r *http.Request, status int, code string, detail string) *problem {
+	return &problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestId: logging.RequestID(r.Context()),
+	}
+}
+
+func (p *problem) write(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	writeJSON(w, r, p.Status, p)
+}
+
+// writeProblem answers with a problem+json body.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	newProblem(r, status, code, detail).write(w, r)
+}
+
+// problemFor returns the problem matching a typed store error: 404 for
+// store.ErrNotFound, 409 for store.ErrConflict and 422 for
+// store.ErrValidation. It returns nil for any other error.
+func problemFor(r *http.Request, err error) *problem {
+	var storeErr *store.Error
+	var validationErr *store.ValidationError
+
+	switch {
+	case errors.As(err, &validationErr):
+		p := newProblem(r, http.StatusUnprocessableEntity, "validation_failed", "request contains invalid fields")
+		p.Errors = validationErr.Fields
+		return p
+	case errors.As(err, &storeErr) && errors.Is(err, store.ErrNotFound):
+		return newProblem(r, http.StatusNotFound, storeErr.Code, storeErr.Message)
+	case errors.As(err, &storeErr) && errors.Is(err, store.ErrConflict):
+		return newProblem(r, http.StatusConflict, storeErr.Code, storeErr.Message)
+	}
+
+	return nil
+}
+
+// writeError answers with the problem matching a typed store error. Any other
+// error is logged and answered with a 500 that doesn't leak its details.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if p := problemFor(r, err); p != nil {
+		p.write(w, r)
+		return
+	}
+
+	logger(r).Errorf("%v\n", err)
+	writeProblem(w, r, http.StatusInternalServerError, "internal_error", "")
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// envelope wraps a response body in a named field, e.g.
+// {"directions": [...]}.
+type envelope map[string]interface{}
+
+// writeJSON marshals resp and writes it with the given status code.
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, resp interface{}) {
+	respBytes, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		logger(r).Errorf("failed to marshal response: %v", err)
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(code)
+	if _, err := w.Write(respBytes); err != nil {
+		logger(r).Errorf("failed to write response: %v", err)
+	}
+}
+
+// decodeJSON reads the request body into v. If the body isn't valid JSON it
+// answers 400 and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "invalid_json", fmt.Sprintf("request body is not valid JSON: %v", err))
+		return false
+	}
+	return true
+}
+
+// pathId parses the named route variable as an id. If it isn't a number it
+// answers 400 and returns false.
+func pathId(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)[name])
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "invalid_id", fmt.Sprintf("%s must be a number", name))
+		return 0, false
+	}
+	return id, true
+}
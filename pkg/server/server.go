@@ -1,41 +1,113 @@
 package server
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/JulianaOsi/medhelp/pkg/config"
+	"github.com/JulianaOsi/medhelp/pkg/metrics"
+	"github.com/JulianaOsi/medhelp/pkg/store"
 )
 
-func LaunchServer() {
+// LaunchServer serves the API until the process receives SIGINT or SIGTERM,
+// then stops accepting connections and waits up to conf.ShutdownTimeout for
+// in-flight requests, such as file uploads, to finish.
+func LaunchServer(conf *config.ServerConfig) error {
 	r := mux.NewRouter()
+	// Panics of routed requests are recovered inside metrics and tracing, so
+	// they are counted and traced as the 500 they are answered with.
+	r.Use(metricsMiddleware, tracingMiddleware, recoveryMiddleware)
+
+	if err := metrics.RegisterPool(store.DB.Stat); err != nil {
+		return fmt.Errorf("failed to register pool metrics: %v", err)
+	}
 
 	r.HandleFunc("/registration", registrationHandler).Methods(http.MethodPost)
 	r.HandleFunc("/auth", authenticationHandler).Methods(http.MethodPost)
-	r.HandleFunc("/directions", getDirections).Methods(http.MethodGet)
-	r.HandleFunc("/directions/add", addDirection).Methods(http.MethodPost)
-	r.HandleFunc("/direction/{id}", getDirection).Methods(http.MethodGet)
-	r.HandleFunc("/direction/{id}/analysis", getDirectionAnalysis).Methods(http.MethodGet)
-	r.HandleFunc("/analysis/{analysis}/upload", uploadAnalysisFile).Methods(http.MethodPost)
-	r.HandleFunc("/analysis/{analysis}/download", downloadAnalysisFile).Methods(http.MethodGet)
-	r.HandleFunc("/status", setDirectionStatus).Methods(http.MethodPost)
-	r.HandleFunc("/check", setAnalysisCheck).Methods(http.MethodPost)
-
-	/*CORS pre-flight requests*/
-	r.HandleFunc("/registration", corsSkip).Methods(http.MethodOptions)
-	r.HandleFunc("/auth", corsSkip).Methods(http.MethodOptions)
-	r.HandleFunc("/directions", corsSkip).Methods(http.MethodOptions)
-	r.HandleFunc("/directions/add", corsSkip).Methods(http.MethodOptions)
-	r.HandleFunc("/direction/{id}", getDirection).Methods(http.MethodGet)
-	r.HandleFunc("/direction/{id}/analysis", corsSkip).Methods(http.MethodOptions)
-	r.HandleFunc("/analysis/{analysis}/upload", corsSkip).Methods(http.MethodOptions)
-	r.HandleFunc("/analysis/{analysis}/download", corsSkip).Methods(http.MethodOptions)
-	r.HandleFunc("/status", corsSkip).Methods(http.MethodOptions)
-	r.HandleFunc("/check", corsSkip).Methods(http.MethodOptions)
-
-	fmt.Printf("Starting server at localhost:8080\n")
-	if err := http.ListenAndServe(":8080", r); err != nil {
-		log.Fatal(err)
+	r.HandleFunc("/auth/refresh", refreshHandler).Methods(http.MethodPost)
+	r.HandleFunc("/healthz", healthHandler).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", readyHandler).Methods(http.MethodGet)
+	r.HandleFunc("/version", versionHandler).Methods(http.MethodGet)
+	r.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/analysis/{analysis}/uploads", tusOptions).Methods(http.MethodOptions)
+
+	api := r.NewRoute().Subrouter()
+	api.Use(authMiddleware)
+	api.HandleFunc("/auth/logout", logoutHandler).Methods(http.MethodPost)
+	api.HandleFunc("/directions", getDirections).Methods(http.MethodGet)
+	api.HandleFunc("/directions/add", addDirection).Methods(http.MethodPost)
+	api.HandleFunc("/direction/{id}", getDirection).Methods(http.MethodGet)
+	api.HandleFunc("/direction/{id}/history", getDirectionHistory).Methods(http.MethodGet)
+	api.HandleFunc("/direction/{id}/analysis", getDirectionAnalysis).Methods(http.MethodGet)
+	api.HandleFunc("/direction/{id}/analysis/add", addDirectionAnalysis).Methods(http.MethodPost)
+	api.HandleFunc("/analysis/{analysis}/remove", removeDirectionAnalysis).Methods(http.MethodPost)
+	api.HandleFunc("/analysis/{analysis}/upload", uploadAnalysisFile).Methods(http.MethodPost)
+	api.HandleFunc("/analysis/{analysis}/download", downloadAnalysisFile).Methods(http.MethodGet, http.MethodHead)
+	api.HandleFunc("/analysis/{analysis}/uploads", createUpload).Methods(http.MethodPost)
+	api.HandleFunc("/upload/{id}", headUpload).Methods(http.MethodHead)
+	api.HandleFunc("/upload/{id}", patchUpload).Methods(http.MethodPatch)
+	api.HandleFunc("/upload/{id}", deleteUpload).Methods(http.MethodDelete)
+	api.HandleFunc("/status", setDirectionStatus).Methods(http.MethodPost)
+	api.HandleFunc("/check", setAnalysisCheck).Methods(http.MethodPost)
+	api.HandleFunc("/analysis/{analysis}/review", reviewAnalysis).Methods(http.MethodPost)
+	api.HandleFunc("/invites", getInvites).Methods(http.MethodGet)
+	api.HandleFunc("/invites/add", addInvite).Methods(http.MethodPost)
+	api.HandleFunc("/invite/{id}/revoke", revokeInvite).Methods(http.MethodPost)
+	api.HandleFunc("/catalog/analyses", getCatalogAnalyses).Methods(http.MethodGet)
+	api.HandleFunc("/catalog/analyses/add", addCatalogAnalysis).Methods(http.MethodPost)
+	api.HandleFunc("/catalog/analysis/{id}", getCatalogAnalysis).Methods(http.MethodGet)
+	api.HandleFunc("/catalog/analysis/{id}/update", updateCatalogAnalysis).Methods(http.MethodPost)
+	api.HandleFunc("/catalog/analysis/{id}/remove", removeCatalogAnalysis).Methods(http.MethodPost)
+	api.HandleFunc("/catalog/icd-rules", getIcdRules).Methods(http.MethodGet)
+	api.HandleFunc("/catalog/icd-rules/add", addIcdRule).Methods(http.MethodPost)
+	api.HandleFunc("/catalog/icd-rule/{id}/update", updateIcdRule).Methods(http.MethodPost)
+	api.HandleFunc("/catalog/icd-rule/{id}/remove", removeIcdRule).Methods(http.MethodPost)
+	api.HandleFunc("/icd/search", searchIcd10).Methods(http.MethodGet)
+
+	handler := loggingMiddleware(recoveryMiddleware(corsMiddleware(conf.CORSOrigins)(r)))
+
+	srv := &http.Server{
+		Addr:              conf.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: conf.ReadHeaderTimeout,
+		ReadTimeout:       conf.ReadTimeout,
+		WriteTimeout:      conf.WriteTimeout,
+		IdleTimeout:       conf.IdleTimeout,
+	}
+
+	cleanupCtx, stopCleanup := context.WithCancel(context.Background())
+	defer stopCleanup()
+	go cleanupUploads(cleanupCtx, uploadCleanupInterval)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Starting server at %s\n", conf.Listen)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-stop:
+		fmt.Printf("Received %v, shutting down\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down server: %v", err)
 	}
+	return nil
 }
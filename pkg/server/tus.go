@@ -0,0 +1,339 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/JulianaOsi/medhelp/pkg/config"
+	"github.com/JulianaOsi/medhelp/pkg/policy"
+	"github.com/JulianaOsi/medhelp/pkg/store"
+)
+
+// Resumable uploads follow the tus protocol (https://tus.io/protocols/resumable-upload.html)
+// with the creation, expiration and termination extensions. An upload is
+// created for an analysis, receives the file in PATCH requests that can be
+// resumed from the last received byte, and is attached to the analysis once
+// all bytes have arrived.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	tusChunkType  = "application/offset+octet-stream"
+)
+
+// uploadCleanupInterval is how often expired uploads are removed.
+const uploadCleanupInterval = 10 * time.Minute
+
+// tusOptions answers the tus discovery request, which is sent without
+// credentials.
+func tusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(config.MaxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func createUpload(w http.ResponseWriter, r *http.Request) {
+	analysisId, ok := pathId(w, r, "analysis")
+	if !ok {
+		return
+	}
+
+	if !authorize(w, r, policy.Upload, policy.Instance(policy.Analysis, analysisId)) {
+		return
+	}
+
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		writeProblem(w, r, http.StatusBadRequest, "invalid_upload_length", "Upload-Length must be a positive number of bytes")
+		return
+	}
+	if length > config.MaxUploadSize {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "file_too_large",
+			fmt.Sprintf("files larger than %d bytes are not accepted", config.MaxUploadSize))
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "invalid_upload_metadata", err.Error())
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+
+	session, err := store.DB.CreateUploadSession(r.Context(), store.NewUploadSession{
+		AnalysisId: analysisId,
+		CreatedBy:  claimsFromContext(r.Context()).UserId,
+		Length:     length,
+		Filename:   filename,
+		ExpiresAt:  time.Now().Add(config.UploadExpiry),
+	})
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to create upload: %w", err))
+		return
+	}
+
+	w.Header().Set("Location", "/upload/"+session.Id)
+	setUploadHeaders(w, session)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// headUpload tells the client where to resume the upload.
+func headUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := uploadSession(w, r)
+	if !ok {
+		return
+	}
+
+	setUploadHeaders(w, session)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func patchUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := uploadSession(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != tusChunkType {
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "invalid_content_type",
+			"chunks must be sent as "+tusChunkType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != session.Offset {
+		writeProblem(w, r, http.StatusConflict, "upload_offset_mismatch",
+			fmt.Sprintf("the upload is at offset %d and accepts no other", session.Offset))
+		return
+	}
+
+	limit := &uploadLimit{r: r.Body, max: session.Length - session.Offset}
+	body := &partialBody{r: limit}
+
+	session, err = store.DB.AppendUploadChunk(detached{r.Context()}, session.Id, offset, body, time.Now().Add(config.UploadExpiry))
+	if limit.exceeded {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "upload_length_exceeded",
+			"the chunk extends past Upload-Length")
+		return
+	}
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to append chunk: %w", err))
+		return
+	}
+	if body.err != nil {
+		logger(r).Infof("upload %s interrupted at offset %d: %v\n", session.Id, session.Offset, body.err)
+	}
+
+	if session.Complete() && !finishUpload(w, r, session) {
+		return
+	}
+
+	setUploadHeaders(w, session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := uploadSession(w, r)
+	if !ok {
+		return
+	}
+
+	if err := store.DB.DeleteUploadSession(r.Context(), session.Id); err != nil {
+		writeError(w, r, fmt.Errorf("failed to delete upload: %w", err))
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadSession returns the upload named in the path. Only the user who
+// created an upload can see it, while they may still upload the analysis
+// file.
+func uploadSession(w http.ResponseWriter, r *http.Request) (*store.UploadSession, bool) {
+	if !checkTusVersion(w, r) {
+		return nil, false
+	}
+
+	session, err := store.DB.GetUploadSession(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to get upload: %w", err))
+		return nil, false
+	}
+
+	userId := claimsFromContext(r.Context()).UserId
+	if session == nil || session.CreatedBy == nil || userId == nil || *session.CreatedBy != *userId {
+		writeProblem(w, r, http.StatusNotFound, "upload_not_found", "there is no such upload")
+		return nil, false
+	}
+	if session.Expired() {
+		writeProblem(w, r, http.StatusGone, "upload_expired", "the upload has expired")
+		return nil, false
+	}
+
+	if !authorize(w, r, policy.Upload, policy.Instance(policy.Analysis, session.AnalysisId)) {
+		return nil, false
+	}
+
+	return session, true
+}
+
+// finishUpload checks the type of the received file and attaches it to the
+// analysis. A file of a type that isn't accepted ends the upload. If attaching
+// fails otherwise, the client can retry with an empty PATCH at the final
+// offset. It answers the request itself only if it fails.
+func finishUpload(w http.ResponseWriter, r *http.Request, session *store.UploadSession) bool {
+	chunks, err := store.DB.OpenUpload(r.Context(), session.Id)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to open upload: %w", err))
+		return false
+	}
+	defer chunks.Close()
+
+	content, contentType, err := sniffUpload(chunks)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to read upload: %w", err))
+		return false
+	}
+	if contentType == "" {
+		if err := store.DB.DeleteUploadSession(r.Context(), session.Id); err != nil {
+			writeError(w, r, fmt.Errorf("failed to delete upload: %w", err))
+			return false
+		}
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "unsupported_file_type",
+			"only PDF, JPEG, PNG and DICOM files are accepted")
+		return false
+	}
+
+	_, err = store.DB.CompleteUploadSession(r.Context(), session, store.NewFile{
+		Content:      content,
+		OriginalName: session.Filename,
+		Size:         session.Length,
+		ContentType:  contentType,
+	}, claimsFromContext(r.Context()).UserId)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("failed to complete upload: %w", err))
+		return false
+	}
+	return true
+}
+
+func setUploadHeaders(w http.ResponseWriter, session *store.UploadSession) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// checkTusVersion refuses requests of tus versions other than tusVersion.
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") == tusVersion {
+		return true
+	}
+
+	w.Header().Set("Tus-Version", tusVersion)
+	writeProblem(w, r, http.StatusPreconditionFailed, "unsupported_tus_version",
+		"only tus "+tusVersion+" is supported")
+	return false
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header: comma separated
+// pairs of a key and its base64 encoded value, which may be left out.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	var metadata = map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, fmt.Errorf("malformed pair %q", pair)
+		}
+
+		key := parts[0]
+		if _, ok := metadata[key]; ok {
+			return nil, fmt.Errorf("duplicate key %q", key)
+		}
+
+		var value []byte
+		if len(parts) == 2 {
+			var err error
+			value, err = base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("value of %q is not base64: %v", key, err)
+			}
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// partialBody turns a failed read of a chunk into its end, so the bytes that
+// arrived before the client went away are kept and the upload can be resumed
+// after them. An oversized chunk still fails.
+type partialBody struct {
+	r   io.Reader
+	err error
+}
+
+func (b *partialBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF && err != errUploadTooLarge {
+		b.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// detached keeps the values of a context, such as the trace, but not its
+// cancellation, so the chunk received before a client went away is still
+// recorded.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// cleanupUploads removes expired uploads every interval until ctx is done.
+func cleanupUploads(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deleted, err := store.DB.DeleteExpiredUploadSessions(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			logrus.Errorf("failed to delete expired uploads: %v\n", err)
+		}
+		if deleted > 0 {
+			logrus.Infof("deleted %d expired uploads\n", deleted)
+		}
+	}
+}
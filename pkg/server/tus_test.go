@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseUploadMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", header: "", want: map[string]string{}},
+		{name: "blank", header: "   ", want: map[string]string{}},
+		{
+			name:   "single pair",
+			header: "filename Ymxvb2QucGRm",
+			want:   map[string]string{"filename": "blood.pdf"},
+		},
+		{
+			name:   "several pairs with spaces",
+			header: "filename Ymxvb2QucGRm, filetype YXBwbGljYXRpb24vcGRm",
+			want:   map[string]string{"filename": "blood.pdf", "filetype": "application/pdf"},
+		},
+		{
+			name:   "key without value",
+			header: "is_confidential,filename YS5wbmc=",
+			want:   map[string]string{"is_confidential": "", "filename": "a.png"},
+		},
+		{
+			name:   "non-ascii value",
+			header: "filename 0LDQvdCw0LvQuNC3LnBkZg==",
+			want:   map[string]string{"filename": "анализ.pdf"},
+		},
+		{name: "malformed base64", header: "filename Ymxvb2QucGRm!", wantErr: true},
+		{name: "unpadded base64", header: "filename YS5wbmc", wantErr: true},
+		{name: "url alphabet", header: "filename _-8=", wantErr: true},
+		{name: "duplicate key", header: "filename YQ==,filename Yg==", wantErr: true},
+		{name: "empty pair", header: "filename YQ==,,name Yg==", wantErr: true},
+		{name: "trailing comma", header: "filename YQ==,", wantErr: true},
+		{name: "too many fields", header: "filename YQ== Yg==", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUploadMetadata(tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseUploadMetadata(%q) = %v, want error", tt.header, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseUploadMetadata(%q) failed: %v", tt.header, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUploadMetadata(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkBody(t *testing.T) {
+	errGone := errors.New("connection reset")
+
+	tests := []struct {
+		name string
+		// body is what the client sends, cut by errGone after cut bytes
+		// if cut is not negative.
+		body      string
+		cut       int
+		remaining int64
+		want      string
+		wantErr   error
+		exceeded  bool
+		wantBody  error
+	}{
+		{name: "whole chunk", body: "0123456789", cut: -1, remaining: 10, want: "0123456789"},
+		{name: "shorter than the rest", body: "01234", cut: -1, remaining: 10, want: "01234"},
+		{name: "empty chunk", body: "", cut: -1, remaining: 10, want: ""},
+		{name: "empty chunk at the end", body: "", cut: -1, remaining: 0, want: ""},
+		{
+			name: "client went away", body: "0123456789", cut: 4, remaining: 10,
+			want: "0123", wantBody: errGone,
+		},
+		{
+			name: "past upload length", body: "0123456789", cut: -1, remaining: 5,
+			wantErr: errUploadTooLarge, exceeded: true,
+		},
+		{
+			name: "past an upload that is complete", body: "0", cut: -1, remaining: 0,
+			wantErr: errUploadTooLarge, exceeded: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var client = iotest.OneByteReader(strings.NewReader(tt.body))
+			if tt.cut >= 0 {
+				client = &failingReader{data: []byte(tt.body[:tt.cut]), err: errGone}
+			}
+
+			limit := &uploadLimit{r: client, max: tt.remaining}
+			body := &partialBody{r: limit}
+
+			got, err := ioutil.ReadAll(body)
+			if err != tt.wantErr {
+				t.Fatalf("reading the chunk failed with %v, want %v", err, tt.wantErr)
+			}
+			if limit.exceeded != tt.exceeded {
+				t.Errorf("exceeded = %v, want %v", limit.exceeded, tt.exceeded)
+			}
+			if body.err != tt.wantBody {
+				t.Errorf("interrupted by %v, want %v", body.err, tt.wantBody)
+			}
+			if tt.wantErr == nil && string(got) != tt.want {
+				t.Errorf("received %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// failingReader returns data and then err instead of io.EOF.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLen is how many leading bytes of an upload are used to detect its
+// type. DICOM files carry their magic after a 128 byte preamble.
+const sniffLen = 512
+
+// uploadTypes lists the accepted analysis file types and the extension a
+// downloaded file of that type is given.
+var uploadTypes = map[string]string{
+	"application/pdf":   ".pdf",
+	"image/jpeg":        ".jpg",
+	"image/png":         ".png",
+	"application/dicom": ".dcm",
+}
+
+var errUploadTooLarge = errors.New("upload is too large")
+
+// uploadedFile returns the "file" part of a multipart request without reading
+// the whole body first.
+func uploadedFile(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("no file field in the request")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
+
+// detectUploadType returns the type of a file from its first bytes, or an
+// empty string if it isn't one of uploadTypes.
+func detectUploadType(head []byte) string {
+	if len(head) >= 132 && bytes.Equal(head[128:132], []byte("DICM")) {
+		return "application/dicom"
+	}
+
+	contentType := http.DetectContentType(head)
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	if _, ok := uploadTypes[contentType]; ok {
+		return contentType
+	}
+	return ""
+}
+
+// sniffUpload reads the head of r to detect its type and returns a reader
+// that still yields all of r.
+func sniffUpload(r io.Reader) (io.Reader, string, error) {
+	buffered := bufio.NewReaderSize(r, sniffLen)
+
+	head, err := buffered.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, "", err
+	}
+
+	return buffered, detectUploadType(head), nil
+}
+
+// uploadLimit fails the read that takes the upload past max bytes, so an
+// oversized file is refused while it is still being streamed.
+type uploadLimit struct {
+	r        io.Reader
+	max      int64
+	read     int64
+	exceeded bool
+}
+
+func (l *uploadLimit) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		l.exceeded = true
+		return 0, errUploadTooLarge
+	}
+	return n, err
+}
+
+// byteCounter remembers the status and counts the body bytes written by the
+// wrapped handler.
+type byteCounter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (c *byteCounter) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.written += int64(n)
+	return n, err
+}
+
+// downloadExt returns the extension a downloaded file is given: the one of its
+// type, or of the name it was uploaded with for files uploaded before types
+// were checked.
+func downloadExt(contentType string, uploadedName string) string {
+	if ext, ok := uploadTypes[contentType]; ok {
+		return ext
+	}
+	return filepath.Ext(uploadedName)
+}
+
+// contentDisposition builds an attachment header that is safe for any file
+// name: an ASCII-only fallback for old clients and the exact UTF-8 name as
+// filename* (RFC 6266, RFC 5987).
+func contentDisposition(name string) string {
+	var fallback, encoded strings.Builder
+
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback.String(), encoded.String())
+}
+
+// isAttrChar reports whether b may appear unescaped in an RFC 5987 value.
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// dicom returns a DICOM file head: a preamble of n bytes followed by magic.
+func dicom(n int, magic string) []byte {
+	return append(make([]byte, n), magic...)
+}
+
+func TestDetectUploadType(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{name: "pdf", head: []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n1 0 obj"), want: "application/pdf"},
+		{name: "jpeg", head: []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), want: "image/jpeg"},
+		{name: "png", head: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), want: "image/png"},
+		{name: "dicom", head: dicom(128, "DICM\x02\x00\x00\x00UL"), want: "application/dicom"},
+		{name: "dicom magic only", head: dicom(128, "DICM"), want: "application/dicom"},
+		{name: "dicom preamble cut short", head: dicom(128, "DIC"), want: ""},
+		{name: "dicom preamble too short", head: dicom(100, "DICM"), want: ""},
+		{name: "dicom magic misplaced", head: dicom(129, "DICM"), want: ""},
+		{name: "dicom magic at the start", head: []byte("DICM"), want: ""},
+		{name: "zero preamble only", head: make([]byte, 132), want: ""},
+		{name: "empty", head: nil, want: ""},
+		{name: "gif", head: []byte("GIF89a\x01\x00\x01\x00"), want: ""},
+		{name: "zip", head: []byte("PK\x03\x04\x14\x00\x00\x00"), want: ""},
+		{name: "html", head: []byte("<!DOCTYPE html><html><script>alert(1)</script>"), want: ""},
+		{name: "text", head: []byte("glucose 5.4 mmol/l"), want: ""},
+		{name: "pdf renamed from text", head: []byte(" %PDF-1.7"), want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectUploadType(tt.head); got != tt.want {
+				t.Errorf("detectUploadType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniffUpload(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{name: "empty", content: nil, want: ""},
+		{name: "shorter than the sniffed head", content: []byte("%PDF-1.4"), want: "application/pdf"},
+		{name: "longer than the sniffed head", content: dicom(128, "DICM"+strings.Repeat("x", 2*sniffLen)), want: "application/dicom"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, contentType, err := sniffUpload(bytes.NewReader(tt.content))
+			if err != nil {
+				t.Fatalf("sniffUpload failed: %v", err)
+			}
+			if contentType != tt.want {
+				t.Errorf("type = %q, want %q", contentType, tt.want)
+			}
+
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("reading the upload failed: %v", err)
+			}
+			if !bytes.Equal(got, tt.content) {
+				t.Errorf("the upload lost its sniffed head: read %d bytes, want %d", len(got), len(tt.content))
+			}
+		})
+	}
+}
+
+func TestUploadLimit(t *testing.T) {
+	tests := []struct {
+		size    int
+		max     int64
+		wantErr error
+	}{
+		{size: 0, max: 10},
+		{size: 10, max: 10},
+		{size: 11, max: 10, wantErr: errUploadTooLarge},
+		{size: 1, max: 0, wantErr: errUploadTooLarge},
+	}
+
+	for _, tt := range tests {
+		limit := &uploadLimit{r: bytes.NewReader(make([]byte, tt.size)), max: tt.max}
+		_, err := ioutil.ReadAll(limit)
+		if err != tt.wantErr {
+			t.Errorf("reading %d bytes with a limit of %d failed with %v, want %v", tt.size, tt.max, err, tt.wantErr)
+		}
+		if limit.exceeded != (tt.wantErr != nil) {
+			t.Errorf("reading %d bytes with a limit of %d: exceeded = %v", tt.size, tt.max, limit.exceeded)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{
+			name: "blood test.pdf",
+			want: `attachment; filename="blood test.pdf"; filename*=UTF-8''blood%20test.pdf`,
+		},
+		{
+			name: "Анализ крови.pdf",
+			want: `attachment; filename="______ _____.pdf"; ` +
+				`filename*=UTF-8''%D0%90%D0%BD%D0%B0%D0%BB%D0%B8%D0%B7%20%D0%BA%D1%80%D0%BE%D0%B2%D0%B8.pdf`,
+		},
+		{
+			name: "résumé (1).jpg",
+			want: `attachment; filename="r_sum_ (1).jpg"; filename*=UTF-8''r%C3%A9sum%C3%A9%20%281%29.jpg`,
+		},
+		{
+			name: `a"b\c.png`,
+			want: `attachment; filename="a_b_c.png"; filename*=UTF-8''a%22b%5Cc.png`,
+		},
+		{
+			name: "scan\r\nSet-Cookie: x.dcm",
+			want: `attachment; filename="scan__Set-Cookie: x.dcm"; filename*=UTF-8''scan%0D%0ASet-Cookie%3A%20x.dcm`,
+		},
+		{
+			name: "",
+			want: `attachment; filename=""; filename*=UTF-8''`,
+		},
+		{
+			name: "invalid \xff utf-8.pdf",
+			want: `attachment; filename="invalid _ utf-8.pdf"; filename*=UTF-8''invalid%20%FF%20utf-8.pdf`,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := contentDisposition(tt.name); got != tt.want {
+			t.Errorf("contentDisposition(%q) =\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadExt(t *testing.T) {
+	tests := []struct {
+		contentType  string
+		uploadedName string
+		want         string
+	}{
+		{"application/pdf", "scan.PNG", ".pdf"},
+		{"application/dicom", "image", ".dcm"},
+		{"", "legacy.docx", ".docx"},
+		{"", "no extension", ""},
+	}
+
+	for _, tt := range tests {
+		if got := downloadExt(tt.contentType, tt.uploadedName); got != tt.want {
+			t.Errorf("downloadExt(%q, %q) = %q, want %q", tt.contentType, tt.uploadedName, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/jackc/pgx/v4"
+)
+
+// CatalogAnalysis is an analysis that can be required for a direction.
+// ValidityDays is how long a result stays valid, if it expires at all.
+type CatalogAnalysis struct {
+	Id           int    `json:"id"`
+	Code         string `json:"code"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	Preparation  string `json:"preparation"`
+	ValidityDays *int   `json:"validityDays"`
+}
+
+type NewCatalogAnalysis struct {
+	Code         string `json:"code"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	Preparation  string `json:"preparation"`
+	ValidityDays *int   `json:"validity_days"`
+}
+
+// IcdRule requires an analysis for directions with an ICD code covered by
+// IcdCode. Rules are never changed in place: a change ends the rule at
+// ValidTo and starts a new version that Replaces it, so directions keep the
+// analyses they were created with.
+type IcdRule struct {
+	Id         int        `json:"id"`
+	IcdCode    string     `json:"icdCode"`
+	AnalysisId int        `json:"analysisId"`
+	ValidFrom  time.Time  `json:"validFrom"`
+	ValidTo    *time.Time `json:"validTo"`
+	Replaces   *int       `json:"replaces"`
+	CreatedBy  *int       `json:"createdBy"`
+}
+
+type NewIcdRule struct {
+	IcdCode    string `json:"icd_code"`
+	AnalysisId *int   `json:"analysis_id"`
+}
+
+var catalogAnalysisColumns = []interface{}{"id", "code", "name", "description", "preparation", "validity_days"}
+
+var icdRuleColumns = []interface{}{"id", "icd_code", "analysis_id", "valid_from", "valid_to", "replaces_id", "created_by"}
+
+func (s *Store) GetCatalogAnalyses(ctx context.Context) ([]*CatalogAnalysis, error) {
+	ctx, span := startSpan(ctx, "GetCatalogAnalyses")
+	defer span.End()
+
+	sql, _, err := goqu.Select(catalogAnalysisColumns...).
+		From("analysis").
+		Order(goqu.C("name").Asc()).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := s.connPool.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var analyses []*CatalogAnalysis
+
+	for rows.Next() {
+		analysis, err := readCatalogAnalysis(rows)
+		if err != nil {
+			return nil, fmt.Errorf("read analysis failed: %v", err)
+		}
+		analyses = append(analyses, analysis)
+	}
+
+	return analyses, nil
+}
+
+func (s *Store) GetCatalogAnalysis(ctx context.Context, id int) (*CatalogAnalysis, error) {
+	ctx, span := startSpan(ctx, "GetCatalogAnalysis")
+	defer span.End()
+
+	sql, _, err := goqu.Select(catalogAnalysisColumns...).
+		From("analysis").
+		Where(goqu.C("id").Eq(id)).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	analysis, err := readCatalogAnalysis(s.connPool.QueryRow(ctx, sql))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return analysis, nil
+}
+
+func (s *Store) CreateCatalogAnalysis(ctx context.Context, analysis NewCatalogAnalysis) (*CatalogAnalysis, error) {
+	ctx, span := startSpan(ctx, "CreateCatalogAnalysis")
+	defer span.End()
+
+	if err := analysis.Validate(); err != nil {
+		return nil, err
+	}
+
+	sql, _, err := goqu.Insert("analysis").
+		Rows(analysis.record()).
+		Returning(catalogAnalysisColumns...).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	created, err := readCatalogAnalysis(s.connPool.QueryRow(ctx, sql))
+	if isUniqueViolation(err) {
+		return nil, conflict("analysis_code_taken", "an analysis with this code already exists")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return created, nil
+}
+
+// UpdateCatalogAnalysis replaces every field of the analysis.
+func (s *Store) UpdateCatalogAnalysis(ctx context.Context, id int, analysis NewCatalogAnalysis) (*CatalogAnalysis, error) {
+	ctx, span := startSpan(ctx, "UpdateCatalogAnalysis")
+	defer span.End()
+
+	if err := analysis.Validate(); err != nil {
+		return nil, err
+	}
+
+	sql, _, err := goqu.Update("analysis").
+		Set(analysis.record()).
+		Where(goqu.C("id").Eq(id)).
+		Returning(catalogAnalysisColumns...).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	updated, err := readCatalogAnalysis(s.connPool.QueryRow(ctx, sql))
+	switch {
+	case err == pgx.ErrNoRows:
+		return nil, notFound("analysis_not_found", "there is no such analysis")
+	case isUniqueViolation(err):
+		return nil, conflict("analysis_code_taken", "an analysis with this code already exists")
+	case err != nil:
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return updated, nil
+}
+
+// DeleteCatalogAnalysis deletes an analysis that no direction or ICD rule
+// refers to.
+func (s *Store) DeleteCatalogAnalysis(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "DeleteCatalogAnalysis")
+	defer span.End()
+
+	sql, _, err := goqu.Delete("analysis").
+		Where(goqu.C("id").Eq(id)).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	tag, err := s.connPool.Exec(ctx, sql)
+	if foreignKeyViolation(err) != "" {
+		return conflict("analysis_in_use", "the analysis is used by directions or ICD rules")
+	}
+	if err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return notFound("analysis_not_found", "there is no such analysis")
+	}
+
+	return nil
+}
+
+// GetIcdRules returns the rules that were in effect at the given time.
+func (s *Store) GetIcdRules(ctx context.Context, at time.Time) ([]*IcdRule, error) {
+	ctx, span := startSpan(ctx, "GetIcdRules")
+	defer span.End()
+
+	sql, _, err := goqu.Select(icdRuleColumns...).
+		From("icd_analysis").
+		Where(icdRuleValidAt(at)).
+		Order(goqu.C("icd_code").Asc(), goqu.C("analysis_id").Asc()).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := s.connPool.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var rules []*IcdRule
+
+	for rows.Next() {
+		rule, err := readIcdRule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("read icd rule failed: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (s *Store) CreateIcdRule(ctx context.Context, rule NewIcdRule, createdBy *int) (*IcdRule, error) {
+	ctx, span := startSpan(ctx, "CreateIcdRule")
+	defer span.End()
+
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+
+	return insertIcdRule(ctx, s.connPool, rule, nil, createdBy)
+}
+
+// UpdateIcdRule ends the current version of the rule and starts a new one.
+// Directions created under the old version keep their analyses.
+func (s *Store) UpdateIcdRule(ctx context.Context, id int, rule NewIcdRule, createdBy *int) (*IcdRule, error) {
+	ctx, span := startSpan(ctx, "UpdateIcdRule")
+	defer span.End()
+
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := endIcdRule(ctx, tx, id); err != nil {
+		return nil, err
+	}
+
+	created, err := insertIcdRule(ctx, tx, rule, &id, createdBy)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return created, nil
+}
+
+// DeleteIcdRule ends the rule, so new directions no longer get its analysis.
+func (s *Store) DeleteIcdRule(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "DeleteIcdRule")
+	defer span.End()
+
+	return endIcdRule(ctx, s.connPool, id)
+}
+
+func insertIcdRule(ctx context.Context, q querier, rule NewIcdRule, replaces *int, createdBy *int) (*IcdRule, error) {
+	sql, _, err := goqu.Insert("icd_analysis").
+		Rows(goqu.Record{
+			"icd_code":    rule.IcdCode,
+			"analysis_id": *rule.AnalysisId,
+			"replaces_id": replaces,
+			"created_by":  createdBy,
+		}).
+		Returning(icdRuleColumns...).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	created, err := readIcdRule(q.QueryRow(ctx, sql))
+	if foreignKeyViolation(err) == "icd_analysis_analysis_id_fkey" {
+		return nil, invalid("analysis_id", "there is no such analysis")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return created, nil
+}
+
+func endIcdRule(ctx context.Context, q querier, id int) error {
+	sql, _, err := goqu.Update("icd_analysis").
+		Set(goqu.Record{"valid_to": goqu.L("now()")}).
+		Where(goqu.C("id").Eq(id), goqu.C("valid_to").IsNull()).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	tag, err := q.Exec(ctx, sql)
+	if err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return notFound("icd_rule_not_found", "there is no such current ICD rule")
+	}
+
+	return nil
+}
+
+// icdRuleValidAt selects the rule versions in effect at the given time.
+func icdRuleValidAt(at time.Time) exp.Expression {
+	return goqu.And(
+		goqu.C("valid_from").Lte(at),
+		goqu.Or(goqu.C("valid_to").IsNull(), goqu.C("valid_to").Gt(at)),
+	)
+}
+
+func (a NewCatalogAnalysis) record() goqu.Record {
+	return goqu.Record{
+		"code":          a.Code,
+		"name":          a.Name,
+		"description":   a.Description,
+		"preparation":   a.Preparation,
+		"validity_days": a.ValidityDays,
+	}
+}
+
+func readCatalogAnalysis(row pgx.Row) (*CatalogAnalysis, error) {
+	var a CatalogAnalysis
+
+	err := row.Scan(&a.Id, &a.Code, &a.Name, &a.Description, &a.Preparation, &a.ValidityDays)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func readIcdRule(row pgx.Row) (*IcdRule, error) {
+	var r IcdRule
+
+	err := row.Scan(&r.Id, &r.IcdCode, &r.AnalysisId, &r.ValidFrom, &r.ValidTo, &r.Replaces, &r.CreatedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
@@ -3,21 +3,83 @@ package store
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
 	"github.com/jackc/pgx/v4"
 )
 
+// ReviewState is the registrar's verdict on an uploaded analysis.
+type ReviewState string
+
+const (
+	ReviewPending  ReviewState = "pending"
+	ReviewAccepted ReviewState = "accepted"
+	// ReviewRejected means the result itself doesn't allow the direction.
+	ReviewRejected ReviewState = "rejected"
+	// ReviewReuploadRequired means the file can't be used, e.g. the scan is
+	// unreadable or the result has expired, and the patient has to upload a
+	// new one.
+	ReviewReuploadRequired ReviewState = "reupload_required"
+)
+
+func (s ReviewState) Valid() bool {
+	switch s {
+	case ReviewPending, ReviewAccepted, ReviewRejected, ReviewReuploadRequired:
+		return true
+	}
+	return false
+}
+
 type Analysis struct {
-	Id          int    `json:"id"`
-	Name        string `json:"name"`
-	IsChecked   bool   `json:"isChecked"`
-	FileId      *int   `json:"file_id"`
-	DirectionId int    `json:"direction_id"`
+	Id            int         `json:"id"`
+	Name          string      `json:"name"`
+	IsChecked     bool        `json:"isChecked"`
+	ReviewState   ReviewState `json:"reviewState"`
+	ReviewComment string      `json:"reviewComment"`
+	ReviewedAt    *time.Time  `json:"reviewedAt"`
+	ReviewedBy    *int        `json:"reviewedBy"`
+	FileId        *int        `json:"file_id"`
+	// FileName and FileContentType are what the file was uploaded with for
+	// this analysis. The files row may hold another upload's, since
+	// identical files are stored once.
+	FileName        string `json:"fileName"`
+	FileContentType string `json:"fileContentType"`
+	DirectionId     int    `json:"direction_id"`
+}
+
+// AnalysisReview is a review of an analysis by ReviewedBy.
+type AnalysisReview struct {
+	State      ReviewState `json:"state"`
+	Comment    string      `json:"comment"`
+	ReviewedBy *int        `json:"-"`
+}
+
+func (r AnalysisReview) Validate() error {
+	var errs ValidationError
+
+	if !r.State.Valid() {
+		errs.Add("state", "must be pending, accepted, rejected or reupload_required")
+	}
+	if (r.State == ReviewRejected || r.State == ReviewReuploadRequired) && strings.TrimSpace(r.Comment) == "" {
+		errs.Add("comment", "is required to reject an analysis or ask for a new file")
+	}
+
+	return errs.Err()
+}
+
+var analysisColumns = []interface{}{
+	"direction_analysis.id", "name", "review_state", "review_comment", "reviewed_at", "reviewed_by", "file_id",
+	"file_name", "file_content_type", "direction_id",
 }
 
 func (s *Store) GetAnalysisByDirectionId(ctx context.Context, directionId int) ([]*Analysis, error) {
-	sql, _, err := goqu.Select("direction_analysis.id", "name", "is_checked", "file_id", "direction_id").
+	ctx, span := startSpan(ctx, "GetAnalysisByDirectionId")
+	defer span.End()
+
+	sql, _, err := goqu.Select(analysisColumns...).
 		From("direction_analysis").
 		Where(goqu.C("direction_id").Eq(directionId)).
 		LeftJoin(
@@ -51,7 +113,10 @@ func (s *Store) GetAnalysisByDirectionId(ctx context.Context, directionId int) (
 }
 
 func (s *Store) GetAnalysisById(ctx context.Context, id int) (*Analysis, error) {
-	sql, _, err := goqu.Select("direction_analysis.id", "name", "is_checked", "file_id", "direction_id").
+	ctx, span := startSpan(ctx, "GetAnalysisById")
+	defer span.End()
+
+	sql, _, err := goqu.Select(analysisColumns...).
 		From("direction_analysis").
 		Where(goqu.L("\"direction_analysis\".\"id\"").Eq(id)).
 		LeftJoin(
@@ -87,49 +152,431 @@ func (s *Store) GetAnalysisById(ctx context.Context, id int) (*Analysis, error)
 	return analysis[0], nil
 }
 
-func (s *Store) SetAnalysisState(ctx context.Context, analysisId int, isChecked bool) error {
+// GetAnalysisOwner returns the owner of the direction the analysis belongs to.
+func (s *Store) GetAnalysisOwner(ctx context.Context, id int) (*DirectionOwner, error) {
+	ctx, span := startSpan(ctx, "GetAnalysisOwner")
+	defer span.End()
+
+	sql, _, err := goqu.Select("patient_id", "doctor_id").
+		From("direction_analysis").
+		Join(
+			goqu.T("direction"),
+			goqu.On(goqu.Ex{
+				"direction.id": goqu.I("direction_analysis.direction_id"),
+			}),
+		).
+		Where(goqu.L("\"direction_analysis\".\"id\"").Eq(id)).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var owner DirectionOwner
+	err = s.connPool.QueryRow(ctx, sql).Scan(&owner.PatientId, &owner.DoctorId)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return &owner, nil
+}
+
+// ReviewAnalysis records the review of an analysis and recalculates the
+// status of its direction. An accepted analysis may be reviewed again while
+// its direction is open. It returns ErrConflict if the direction is closed.
+func (s *Store) ReviewAnalysis(ctx context.Context, analysisId int, review AnalysisReview) error {
+	ctx, span := startSpan(ctx, "ReviewAnalysis")
+	defer span.End()
+
+	if err := review.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	directionId, _, err := lockOpenAnalysis(ctx, tx, analysisId)
+	if err != nil {
+		return err
+	}
+
 	sql, _, err := goqu.Update("direction_analysis").
-		Set(goqu.Record{"is_checked": isChecked}).
+		Set(goqu.Record{
+			"review_state":   review.State,
+			"review_comment": review.Comment,
+			"reviewed_at":    goqu.L("now()"),
+			"reviewed_by":    review.ReviewedBy,
+		}).
 		Where(goqu.C("id").Eq(analysisId)).
 		ToSQL()
 	if err != nil {
 		return fmt.Errorf("sql query build failed: %v", err)
 	}
 
-	_, err = s.connPool.Exec(ctx, sql)
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
 
+	previous, status, err := recalculateDirectionStatus(ctx, tx, directionId, review.ReviewedBy)
 	if err != nil {
-		return fmt.Errorf("execute a query failed: %v", err)
+		return err
 	}
 
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	countStatusChange(previous, status)
 	return nil
 }
 
-func (s *Store) SetAnalysisFile(ctx context.Context, analysisId int, fileId int) error {
+// SaveAnalysisFile stores the upload as the file of the analysis, which then
+// waits for a new review, and recalculates the status of its direction. It
+// returns ErrConflict if the direction is closed or the analysis has already
+// been accepted.
+func (s *Store) SaveAnalysisFile(ctx context.Context, analysisId int, upload NewFile, changedBy *int) (*File, error) {
+	ctx, span := startSpan(ctx, "SaveAnalysisFile")
+	defer span.End()
+
+	var previous *DirectionStatus
+	var status DirectionStatus
+
+	file, err := s.saveFile(ctx, upload, func(tx pgx.Tx, file *File) error {
+		var err error
+		previous, status, err = setAnalysisFile(ctx, tx, analysisId, file, changedBy)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	countStatusChange(previous, status)
+	return file, nil
+}
+
+// setAnalysisFile attaches the file to the analysis along with the name and
+// type it was uploaded with, and recalculates the status of its direction,
+// returning the previous status if it changed.
+func setAnalysisFile(ctx context.Context, q querier, analysisId int, file *File, changedBy *int) (*DirectionStatus, DirectionStatus, error) {
+	directionId, state, err := lockOpenAnalysis(ctx, q, analysisId)
+	if err != nil {
+		return nil, "", err
+	}
+	if state == ReviewAccepted {
+		return nil, "", conflict("analysis_accepted", "the analysis has already been accepted")
+	}
+
 	sql, _, err := goqu.Update("direction_analysis").
-		Set(goqu.Record{"file_id": fileId}).
+		Set(goqu.Record{
+			"file_id":           file.Id,
+			"file_name":         file.OriginalName,
+			"file_content_type": file.ContentType,
+			"review_state":      ReviewPending,
+			"review_comment":    "",
+			"reviewed_at":       nil,
+			"reviewed_by":       nil,
+		}).
 		Where(goqu.C("id").Eq(analysisId)).
 		ToSQL()
+	if err != nil {
+		return nil, "", fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	if _, err := q.Exec(ctx, sql); err != nil {
+		return nil, "", fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return recalculateDirectionStatus(ctx, q, directionId, changedBy)
+}
+
+// lockOpenAnalysis locks the analysis and its direction and returns the id of
+// the direction and the review state of the analysis. It returns ErrConflict
+// if the direction is closed, so its status must not be derived from the
+// analyses anymore.
+func lockOpenAnalysis(ctx context.Context, q querier, analysisId int) (int, ReviewState, error) {
+	sql, _, err := goqu.Select("direction.id", "direction.status", "direction_analysis.review_state").
+		From("direction_analysis").
+		Join(
+			goqu.T("direction"),
+			goqu.On(goqu.Ex{
+				"direction.id": goqu.I("direction_analysis.direction_id"),
+			}),
+		).
+		Where(goqu.L("\"direction_analysis\".\"id\"").Eq(analysisId)).
+		ForUpdate(exp.Wait).
+		ToSQL()
+	if err != nil {
+		return 0, "", fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var directionId int
+	var status DirectionStatus
+	var state ReviewState
+	err = q.QueryRow(ctx, sql).Scan(&directionId, &status, &state)
+	if err == pgx.ErrNoRows {
+		return 0, "", notFound("analysis_not_found", "there is no such analysis")
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	if status.Closed() {
+		return 0, "", conflict("direction_closed",
+			fmt.Sprintf("the direction is %s and its analyses can no longer change", status))
+	}
+	return directionId, state, nil
+}
+
+// recalculateDirectionStatus derives the direction status from its analyses:
+// rejected if any analysis was rejected, awaiting analyses while a file is
+// missing or has to be uploaded again, approved once every analysis is
+// accepted and under review otherwise. The status is left alone if the
+// direction has no analyses. It returns ErrConflict if the transition isn't
+// allowed, and the previous status if it changed.
+func recalculateDirectionStatus(ctx context.Context, q querier, directionId int, changedBy *int) (*DirectionStatus, DirectionStatus, error) {
+	// Lock the direction before reading its analyses, so that concurrent
+	// reviews of the same direction are recalculated one after another and
+	// the last one sees every review.
+	sql, _, err := goqu.Select("status").
+		From("direction").
+		Where(goqu.C("id").Eq(directionId)).
+		ForUpdate(exp.Wait).
+		ToSQL()
+	if err != nil {
+		return nil, "", fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var current DirectionStatus
+	err = q.QueryRow(ctx, sql).Scan(&current)
+	if err == pgx.ErrNoRows {
+		return nil, "", notFound("direction_not_found", "there is no such direction")
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	sql, _, err = goqu.Select("review_state", "review_comment", "file_id").
+		From("direction_analysis").
+		Where(goqu.C("direction_id").Eq(directionId)).
+		Order(goqu.C("id").Asc()).
+		ToSQL()
+	if err != nil {
+		return nil, "", fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := q.Query(ctx, sql)
+	if err != nil {
+		return nil, "", fmt.Errorf("execute a query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var total, accepted int
+	var missing bool
+	var rejections []string
+
+	for rows.Next() {
+		var state ReviewState
+		var comment string
+		var fileId *int
+		if err := rows.Scan(&state, &comment, &fileId); err != nil {
+			return nil, "", fmt.Errorf("read analysis failed: %v", err)
+		}
+
+		total++
+		switch {
+		case state == ReviewRejected:
+			rejections = append(rejections, comment)
+		case state == ReviewReuploadRequired || fileId == nil:
+			missing = true
+		case state == ReviewAccepted:
+			accepted++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("read analysis failed: %v", err)
+	}
+
+	if total == 0 {
+		return nil, "", nil
+	}
+
+	var change = StatusChange{ChangedBy: changedBy}
+	switch {
+	case len(rejections) > 0:
+		change.Status = StatusRejected
+		change.Reason = "analysis rejected: " + strings.Join(rejections, "; ")
+	case missing:
+		change.Status = StatusAwaitingAnalyses
+		change.Reason = "waiting for analysis files"
+	case accepted == total:
+		change.Status = StatusApproved
+		change.Reason = "all analyses accepted"
+	default:
+		change.Status = StatusUnderReview
+		change.Reason = "all analysis files uploaded"
+	}
+
+	if change.Status == current {
+		return nil, current, nil
+	}
+
+	previous, err := moveDirectionStatus(ctx, q, directionId, change)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return previous, change.Status, nil
+}
+
+// AddDirectionAnalysis adds an analysis to the direction on top of the ones
+// required by its ICD code and recalculates the status of the direction. It
+// returns ErrConflict if the direction is closed.
+func (s *Store) AddDirectionAnalysis(ctx context.Context, directionId int, analysisId int, changedBy *int) (*Analysis, error) {
+	ctx, span := startSpan(ctx, "AddDirectionAnalysis")
+	defer span.End()
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockOpenDirection(ctx, tx, directionId); err != nil {
+		return nil, err
+	}
+
+	sql, _, err := goqu.Insert("direction_analysis").
+		Rows(goqu.Record{
+			"direction_id": directionId,
+			"analysis_id":  analysisId,
+		}).
+		Returning("id").
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var id int
+	err = tx.QueryRow(ctx, sql).Scan(&id)
+	switch {
+	case isUniqueViolation(err):
+		return nil, conflict("analysis_already_added", "the direction already has this analysis")
+	case foreignKeyViolation(err) == "direction_analysis_direction_id_fkey":
+		return nil, notFound("direction_not_found", "there is no such direction")
+	case foreignKeyViolation(err) == "direction_analysis_analysis_id_fkey":
+		return nil, invalid("analysisId", "there is no such analysis")
+	case err != nil:
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	previous, status, err := recalculateDirectionStatus(ctx, tx, directionId, changedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	countStatusChange(previous, status)
+	return s.GetAnalysisById(ctx, id)
+}
+
+// RemoveDirectionAnalysis removes an analysis from its direction and
+// recalculates the status of the direction. An analysis the patient has
+// already uploaded a file for can't be removed, and neither can the analyses
+// of a closed direction.
+func (s *Store) RemoveDirectionAnalysis(ctx context.Context, id int, changedBy *int) error {
+	ctx, span := startSpan(ctx, "RemoveDirectionAnalysis")
+	defer span.End()
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	directionId, _, err := lockOpenAnalysis(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	sql, _, err := goqu.Delete("direction_analysis").
+		Where(goqu.C("id").Eq(id), goqu.C("file_id").IsNull()).
+		ToSQL()
 	if err != nil {
 		return fmt.Errorf("sql query build failed: %v", err)
 	}
 
-	_, err = s.connPool.Exec(ctx, sql)
+	tag, err := tx.Exec(ctx, sql)
+	if foreignKeyViolation(err) == "upload_session_analysis_id_fkey" {
+		return conflict("analysis_upload_in_progress", "a file is being uploaded for this analysis")
+	}
+	if err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return conflict("analysis_has_file", "a file has already been uploaded for this analysis")
+	}
 
+	previous, status, err := recalculateDirectionStatus(ctx, tx, directionId, changedBy)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	countStatusChange(previous, status)
+	return nil
+}
+
+// lockOpenDirection locks the direction. It returns ErrConflict if the
+// direction is closed, so its analyses must not change anymore.
+func lockOpenDirection(ctx context.Context, q querier, directionId int) error {
+	sql, _, err := goqu.Select("status").
+		From("direction").
+		Where(goqu.C("id").Eq(directionId)).
+		ForUpdate(exp.Wait).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var status DirectionStatus
+	err = q.QueryRow(ctx, sql).Scan(&status)
+	if err == pgx.ErrNoRows {
+		return notFound("direction_not_found", "there is no such direction")
+	}
 	if err != nil {
 		return fmt.Errorf("execute a query failed: %v", err)
 	}
 
+	if status.Closed() {
+		return conflict("direction_closed",
+			fmt.Sprintf("the direction is %s and its analyses can no longer change", status))
+	}
+
 	return nil
 }
 
 func readAnalysis(row pgx.Row) (*Analysis, error) {
 	var a Analysis
 
-	err := row.Scan(&a.Id, &a.Name, &a.IsChecked, &a.FileId, &a.DirectionId)
+	err := row.Scan(
+		&a.Id, &a.Name, &a.ReviewState, &a.ReviewComment, &a.ReviewedAt, &a.ReviewedBy, &a.FileId,
+		&a.FileName, &a.FileContentType, &a.DirectionId,
+	)
 	if err != nil {
 		return nil, err
 	}
+	a.IsChecked = a.ReviewState == ReviewAccepted
 
 	return &a, nil
 }
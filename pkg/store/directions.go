@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -10,20 +11,21 @@ import (
 )
 
 type Direction struct {
-	Id                  int       `json:"id"`
-	PatientFirstName    string    `json:"patientFirstName"`
-	PatientLastName     string    `json:"patientLastName"`
-	PatientBirthDate    time.Time `json:"patientBirthDate"`
-	PatientPolicyNumber string    `json:"patientPolicyNumber"`
-	PatientTel          string    `json:"patientTel"`
-	DoctorName          string    `json:"doctorName"`
-	DoctorSpecialty     string    `json:"doctorSpecialty"`
-	Date                time.Time `json:"date"`
-	IcdCode             string    `json:"icdCode"`
-	MedicalOrganization string    `json:"medicalOrganization"`
-	OrganizationContact string    `json:"organizationContact"`
-	Justification       string    `json:"justification"`
-	Status              int       `json:"status"`
+	Id                  int             `json:"id"`
+	PatientFirstName    string          `json:"patientFirstName"`
+	PatientLastName     string          `json:"patientLastName"`
+	PatientBirthDate    time.Time       `json:"patientBirthDate"`
+	PatientPolicyNumber string          `json:"patientPolicyNumber"`
+	PatientTel          string          `json:"patientTel"`
+	DoctorName          string          `json:"doctorName"`
+	DoctorSpecialty     string          `json:"doctorSpecialty"`
+	Date                time.Time       `json:"date"`
+	IcdCode             string          `json:"icdCode"`
+	IcdTitle            *string         `json:"icdTitle"`
+	MedicalOrganization string          `json:"medicalOrganization"`
+	OrganizationContact string          `json:"organizationContact"`
+	Justification       string          `json:"justification"`
+	Status              DirectionStatus `json:"status"`
 }
 
 type NewDirection struct {
@@ -34,10 +36,188 @@ type NewDirection struct {
 	MedicalOrganization string    `json:"medicalOrganization"`
 	OrganizationContact string    `json:"organizationContact"`
 	Justification       string    `json:"justification"`
+	// CreatedBy is the user who added the direction, recorded in its status
+	// history.
+	CreatedBy *int `json:"-"`
+}
+
+// DirectionOwner identifies the patient a direction was issued to and the
+// doctor who issued it.
+type DirectionOwner struct {
+	PatientId int
+	DoctorId  int
+}
+
+// DirectionEntry is one direction of a batch together with the patient and
+// doctor it refers to. The ids of Direction are filled in by the store.
+type DirectionEntry struct {
+	Patient   NewPatient
+	Doctor    NewDoctor
+	Direction NewDirection
+}
+
+func (e DirectionEntry) Validate() error {
+	var errs ValidationError
+
+	errs.Merge("patient", e.Patient.Validate())
+	errs.Merge("doctor", e.Doctor.Validate())
+	if err, ok := e.Direction.Validate().(*ValidationError); ok {
+		errs.Fields = append(errs.Fields, err.Fields...)
+	}
+
+	return errs.Err()
+}
+
+// DirectionResult holds the ids of the patient, doctor and direction of a
+// batch entry and whether each of them was created or matched an existing
+// one. Error is set instead if the entry was rejected.
+type DirectionResult struct {
+	PatientId        int   `json:"patientId,omitempty"`
+	PatientCreated   bool  `json:"patientCreated"`
+	DoctorId         int   `json:"doctorId,omitempty"`
+	DoctorCreated    bool  `json:"doctorCreated"`
+	DirectionId      int   `json:"directionId,omitempty"`
+	DirectionCreated bool  `json:"directionCreated"`
+	Error            error `json:"-"`
+}
+
+// AddDirections adds a batch of directions in one transaction. With atomic
+// set, the first failing entry rolls back the whole batch. Otherwise every
+// entry runs in its own savepoint: an entry rejected because of its content
+// gets an Error in its result and the rest of the batch is still committed,
+// while a database failure rolls back everything.
+func (s *Store) AddDirections(ctx context.Context, entries []DirectionEntry, atomic bool) ([]*DirectionResult, error) {
+	ctx, span := startSpan(ctx, "AddDirections")
+	defer span.End()
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var results = make([]*DirectionResult, 0, len(entries))
+
+	for i, entry := range entries {
+		var result *DirectionResult
+		if atomic {
+			result, err = addDirectionEntry(ctx, tx, entry)
+			// Name the fields of the failing entry the way the validation
+			// of the whole batch does.
+			var fields *ValidationError
+			if errors.As(err, &fields) {
+				var errs ValidationError
+				errs.Merge(fmt.Sprintf("directions[%d]", i), fields)
+				return nil, errs.Err()
+			}
+		} else {
+			result, err = addDirectionEntryInSavepoint(ctx, tx, entry)
+			if err != nil && isRequestError(err) {
+				result, err = &DirectionResult{Error: err}, nil
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to add direction %d: %w", i, err)
+		}
+		results = append(results, result)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return results, nil
 }
 
-func (s *Store) AddDirection(ctx context.Context, direction NewDirection) error {
-	sql, _, err := goqu.Insert("direction").
+func addDirectionEntryInSavepoint(ctx context.Context, tx pgx.Tx, entry DirectionEntry) (*DirectionResult, error) {
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin savepoint: %v", err)
+	}
+	defer savepoint.Rollback(ctx)
+
+	result, err := addDirectionEntry(ctx, savepoint, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := savepoint.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to release savepoint: %v", err)
+	}
+
+	return result, nil
+}
+
+func addDirectionEntry(ctx context.Context, q querier, entry DirectionEntry) (*DirectionResult, error) {
+	var result DirectionResult
+	var err error
+
+	result.PatientId, result.PatientCreated, err = addPatient(ctx, q, entry.Patient)
+	if errors.Is(err, ErrValidation) {
+		// Name the fields the way DirectionEntry.Validate does.
+		var errs ValidationError
+		errs.Merge("patient", err)
+		return nil, errs.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.DoctorId, result.DoctorCreated, err = addDoctor(ctx, q, entry.Doctor)
+	if err != nil {
+		return nil, err
+	}
+
+	direction := entry.Direction
+	direction.PatientId = result.PatientId
+	direction.DoctorId = result.DoctorId
+
+	result.DirectionId, result.DirectionCreated, err = addDirection(ctx, q, direction)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// addDirection adds the direction unless the same doctor already issued one
+// to the patient at the same time, and returns its id and whether it was
+// created. A new direction gets the analyses icd_analysis requires for its
+// ICD code.
+func addDirection(ctx context.Context, q querier, direction NewDirection) (int, bool, error) {
+	ctx, span := startSpan(ctx, "AddDirection")
+	defer span.End()
+
+	if err := direction.Validate(); err != nil {
+		return 0, false, err
+	}
+	if err := checkIcdCode(ctx, q, direction.IcdCode); err != nil {
+		return 0, false, err
+	}
+
+	sql, _, err := goqu.Select("id").
+		From("direction").
+		Where(
+			goqu.C("patient_id").Eq(direction.PatientId),
+			goqu.C("doctor_id").Eq(direction.DoctorId),
+			goqu.C("date").Eq(direction.Date),
+		).
+		Limit(1).
+		ToSQL()
+	if err != nil {
+		return 0, false, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var id int
+	err = q.QueryRow(ctx, sql).Scan(&id)
+	if err == nil {
+		return id, false, nil
+	}
+	if err != pgx.ErrNoRows {
+		return 0, false, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	sql, _, err = goqu.Insert("direction").
 		Rows(goqu.Record{
 			"patient_id":           direction.PatientId,
 			"doctor_id":            direction.DoctorId,
@@ -47,26 +227,39 @@ func (s *Store) AddDirection(ctx context.Context, direction NewDirection) error
 			"organization_contact": direction.OrganizationContact,
 			"justification":        direction.Justification,
 		}).
-		OnConflict(goqu.DoNothing()).
+		Returning("id").
 		ToSQL()
 	if err != nil {
-		return fmt.Errorf("sql query build failed: %v", err)
+		return 0, false, fmt.Errorf("sql query build failed: %v", err)
 	}
 
-	//sql = fmt.Sprintf("INSERT INTO direction(patient_id, doctor_id, date, icd_code, medical_organization, organization_contact, justification)\n" +
-	//	"SELECT '%d', '%d', '%s', '%s', '%s', '%s', '%s'\nWHERE NOT EXISTS (\n    SELECT 1 FROM direction WHERE patient_id='%d' AND doctor_id='%d' AND date='%s'\n" +
-	//	");", direction.PatientId, direction.DoctorId, direction.Date, direction.IcdCode, direction.MedicalOrganization, direction.OrganizationContact, direction.Justification, direction.PatientId, direction.DoctorId, direction.Date)
+	if err := q.QueryRow(ctx, sql).Scan(&id); err != nil {
+		return 0, false, fmt.Errorf("execute a query failed: %v", err)
+	}
 
-	if _, err := s.connPool.Exec(ctx, sql); err != nil {
-		return fmt.Errorf("execute a query failed: %v", err)
+	err = recordStatusChange(ctx, q, id, nil, StatusChange{
+		Status:    StatusNew,
+		ChangedBy: direction.CreatedBy,
+		Reason:    "direction created",
+	})
+	if err != nil {
+		return 0, false, err
 	}
-	return nil
+
+	if err := attachIcdAnalyses(ctx, q, id, direction.IcdCode); err != nil {
+		return 0, false, fmt.Errorf("failed to attach analyses: %v", err)
+	}
+
+	return id, true, nil
 }
 
 func (s *Store) GetDirectionById(ctx context.Context, id int) (*Direction, error) {
+	ctx, span := startSpan(ctx, "GetDirectionById")
+	defer span.End()
+
 	sql, _, err := goqu.Select(
 		"direction.id", "first_name", "last_name", "birth_date", "policy_number", "tel", "name",
-		"specialty", "date", "icd_code", "medical_organization", "organization_contact", "justification", "status",
+		"specialty", "date", "icd_code", "icd10.title", "medical_organization", "organization_contact", "justification", "status",
 	).
 		From("direction").
 		LeftJoin(
@@ -81,6 +274,12 @@ func (s *Store) GetDirectionById(ctx context.Context, id int) (*Direction, error
 				"doctor_id": goqu.I("doctor.id"),
 			}),
 		).
+		LeftJoin(
+			goqu.T("icd10"),
+			goqu.On(goqu.Ex{
+				"icd_code": goqu.I("icd10.code"),
+			}),
+		).
 		Where(goqu.L("\"direction\".\"id\"").Eq(id)).
 		ToSQL()
 	if err != nil {
@@ -111,9 +310,12 @@ func (s *Store) GetDirectionById(ctx context.Context, id int) (*Direction, error
 }
 
 func (s *Store) GetDirections(ctx context.Context) ([]*Direction, error) {
+	ctx, span := startSpan(ctx, "GetDirections")
+	defer span.End()
+
 	sql, _, err := goqu.Select(
 		"direction.id", "first_name", "last_name", "birth_date", "policy_number", "tel", "name",
-		"specialty", "date", "icd_code", "medical_organization", "organization_contact", "justification", "status",
+		"specialty", "date", "icd_code", "icd10.title", "medical_organization", "organization_contact", "justification", "status",
 	).
 		From("direction").
 		LeftJoin(
@@ -128,6 +330,12 @@ func (s *Store) GetDirections(ctx context.Context) ([]*Direction, error) {
 				"doctor_id": goqu.I("doctor.id"),
 			}),
 		).
+		LeftJoin(
+			goqu.T("icd10"),
+			goqu.On(goqu.Ex{
+				"icd_code": goqu.I("icd10.code"),
+			}),
+		).
 		Order(goqu.C("date").Asc()).
 		ToSQL()
 	if err != nil {
@@ -154,9 +362,12 @@ func (s *Store) GetDirections(ctx context.Context) ([]*Direction, error) {
 }
 
 func (s *Store) GetDirectionsByPatientId(ctx context.Context, patientId string) ([]*Direction, error) {
+	ctx, span := startSpan(ctx, "GetDirectionsByPatientId")
+	defer span.End()
+
 	sql, _, err := goqu.Select(
 		"direction.id", "first_name", "last_name", "birth_date", "policy_number", "tel", "name",
-		"specialty", "date", "icd_code", "medical_organization", "organization_contact", "justification", "status",
+		"specialty", "date", "icd_code", "icd10.title", "medical_organization", "organization_contact", "justification", "status",
 	).
 		From("direction").
 		LeftJoin(
@@ -171,6 +382,12 @@ func (s *Store) GetDirectionsByPatientId(ctx context.Context, patientId string)
 				"doctor_id": goqu.I("doctor.id"),
 			}),
 		).
+		LeftJoin(
+			goqu.T("icd10"),
+			goqu.On(goqu.Ex{
+				"icd_code": goqu.I("icd10.code"),
+			}),
+		).
 		Where(goqu.C("patient_id").Eq(patientId)).
 		Order(goqu.C("date").Asc()).
 		ToSQL()
@@ -197,22 +414,81 @@ func (s *Store) GetDirectionsByPatientId(ctx context.Context, patientId string)
 	return directions, nil
 }
 
-func (s *Store) SetDirectionStatus(ctx context.Context, directionId int, statusId int) error {
-	sql, _, err := goqu.Update("direction").
-		Set(goqu.Record{"status": statusId}).
-		Where(goqu.C("id").Eq(directionId)).
+func (s *Store) GetDirectionsByDoctorId(ctx context.Context, doctorId string) ([]*Direction, error) {
+	ctx, span := startSpan(ctx, "GetDirectionsByDoctorId")
+	defer span.End()
+
+	sql, _, err := goqu.Select(
+		"direction.id", "first_name", "last_name", "birth_date", "policy_number", "tel", "name",
+		"specialty", "date", "icd_code", "icd10.title", "medical_organization", "organization_contact", "justification", "status",
+	).
+		From("direction").
+		LeftJoin(
+			goqu.T("patient"),
+			goqu.On(goqu.Ex{
+				"patient_id": goqu.I("patient.id"),
+			}),
+		).
+		LeftJoin(
+			goqu.T("doctor"),
+			goqu.On(goqu.Ex{
+				"doctor_id": goqu.I("doctor.id"),
+			}),
+		).
+		LeftJoin(
+			goqu.T("icd10"),
+			goqu.On(goqu.Ex{
+				"icd_code": goqu.I("icd10.code"),
+			}),
+		).
+		Where(goqu.C("doctor_id").Eq(doctorId)).
+		Order(goqu.C("date").Asc()).
 		ToSQL()
 	if err != nil {
-		return fmt.Errorf("sql query build failed: %v", err)
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := s.connPool.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
 	}
+	defer rows.Close()
 
-	_, err = s.connPool.Exec(ctx, sql)
+	var directions []*Direction
 
+	for rows.Next() {
+		direction, err := readDirection(rows)
+		if err != nil {
+			return nil, fmt.Errorf("read direction failed: %v", err)
+		}
+		directions = append(directions, direction)
+	}
+
+	return directions, nil
+}
+
+func (s *Store) GetDirectionOwner(ctx context.Context, id int) (*DirectionOwner, error) {
+	ctx, span := startSpan(ctx, "GetDirectionOwner")
+	defer span.End()
+
+	sql, _, err := goqu.Select("patient_id", "doctor_id").
+		From("direction").
+		Where(goqu.C("id").Eq(id)).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var owner DirectionOwner
+	err = s.connPool.QueryRow(ctx, sql).Scan(&owner.PatientId, &owner.DoctorId)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		return fmt.Errorf("execute a query failed: %v", err)
+		return nil, fmt.Errorf("execute a query failed: %v", err)
 	}
 
-	return nil
+	return &owner, nil
 }
 
 func readDirection(row pgx.Row) (*Direction, error) {
@@ -221,7 +497,7 @@ func readDirection(row pgx.Row) (*Direction, error) {
 	err := row.Scan(
 		&d.Id, &d.PatientFirstName, &d.PatientLastName, &d.PatientBirthDate,
 		&d.PatientPolicyNumber, &d.PatientTel, &d.DoctorName,
-		&d.DoctorSpecialty, &d.Date, &d.IcdCode, &d.MedicalOrganization,
+		&d.DoctorSpecialty, &d.Date, &d.IcdCode, &d.IcdTitle, &d.MedicalOrganization,
 		&d.OrganizationContact, &d.Justification, &d.Status,
 	)
 	if err != nil {
@@ -20,6 +20,9 @@ type NewDoctor struct {
 }
 
 func (s *Store) GetDoctor(ctx context.Context, name string, specialty string) (*Doctor, error) {
+	ctx, span := startSpan(ctx, "GetDoctor")
+	defer span.End()
+
 	sql, _, err := goqu.Select("id", "name", "specialty").
 		From("doctor").
 		Where(goqu.C("name").Eq(name), goqu.C("specialty").Eq(specialty)).
@@ -50,27 +53,83 @@ func (s *Store) GetDoctor(ctx context.Context, name string, specialty string) (*
 	return doctors[0], nil
 }
 
-func (s *Store) AddDoctor(ctx context.Context, doctor NewDoctor) (*int, error) {
+func (s *Store) GetDoctorById(ctx context.Context, id int) (*Doctor, error) {
+	ctx, span := startSpan(ctx, "GetDoctorById")
+	defer span.End()
+
+	sql, _, err := goqu.Select("id", "name", "specialty").
+		From("doctor").
+		Where(goqu.C("id").Eq(id)).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := s.connPool.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var doctors []*Doctor
+
+	for rows.Next() {
+		doctor, err := readDoctor(rows)
+		if err != nil {
+			return nil, fmt.Errorf("read doctor failed: %v", err)
+		}
+		doctors = append(doctors, doctor)
+	}
+
+	if len(doctors) == 0 {
+		return nil, nil
+	}
+	return doctors[0], nil
+}
+
+// addDoctor adds the doctor unless one with the same name and specialty
+// exists, and returns its id and whether it was created.
+func addDoctor(ctx context.Context, q querier, doctor NewDoctor) (int, bool, error) {
+	ctx, span := startSpan(ctx, "AddDoctor")
+	defer span.End()
+
+	if err := doctor.Validate(); err != nil {
+		return 0, false, err
+	}
+
 	sql, _, err := goqu.Insert("doctor").
 		Rows(goqu.Record{
 			"name":      doctor.Name,
 			"specialty": doctor.Specialty,
 		}).
 		OnConflict(goqu.DoNothing()).
+		Returning("id").
 		ToSQL()
 	if err != nil {
-		return nil, fmt.Errorf("sql query build failed: %v", err)
+		return 0, false, fmt.Errorf("sql query build failed: %v", err)
 	}
-	if _, err := s.connPool.Exec(ctx, sql); err != nil {
-		return nil, fmt.Errorf("execute a query failed: %v", err)
+
+	var id int
+	err = q.QueryRow(ctx, sql).Scan(&id)
+	if err == nil {
+		return id, true, nil
+	}
+	if err != pgx.ErrNoRows {
+		return 0, false, fmt.Errorf("execute a query failed: %v", err)
 	}
 
-	newDoctor, err := s.GetDoctor(context.Background(), doctor.Name, doctor.Specialty)
+	sql, _, err = goqu.Select("id").
+		From("doctor").
+		Where(goqu.C("name").Eq(doctor.Name), goqu.C("specialty").Eq(doctor.Specialty)).
+		ToSQL()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get doctor: %v\n", err)
+		return 0, false, fmt.Errorf("sql query build failed: %v", err)
+	}
+	if err := q.QueryRow(ctx, sql).Scan(&id); err != nil {
+		return 0, false, fmt.Errorf("execute a query failed: %v", err)
 	}
 
-	return &newDoctor.Id, nil
+	return id, false, nil
 }
 
 func readDoctor(row pgx.Row) (*Doctor, error) {
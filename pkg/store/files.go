@@ -2,146 +2,231 @@ package store
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"mime/multipart"
-	"os"
+	"mime"
 	"path/filepath"
-	"strconv"
 	"time"
 
 	"github.com/doug-martin/goqu/v9"
 	"github.com/jackc/pgx/v4"
+
+	"github.com/JulianaOsi/medhelp/pkg/filestore"
+	"github.com/JulianaOsi/medhelp/pkg/metrics"
 )
 
-var directory string
+// File is an uploaded file. Name is the key of its content in the file
+// storage and OriginalName the name it was uploaded with. Files uploaded
+// before hashes were recorded have no Sha256, and their Size comes from the
+// file storage.
+type File struct {
+	Id           int       `json:"id"`
+	Name         string    `json:"-"`
+	OriginalName string    `json:"filename"`
+	Sha256       *string   `json:"sha256"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"contentType"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
 
-func init() {
-	wd, err := os.Getwd()
-	if err != nil {
-		panic(err)
-	}
-	directory = wd + "/files/"
+var fileColumns = []interface{}{
+	"id", "name", "original_name", "sha256", "size", "content_type", "created_at",
 }
 
-type File struct {
-	Id   int    `json:"id"`
-	Name string `json:"filename"`
+// NewFile is an upload to store. Size is -1 if unknown.
+type NewFile struct {
+	Content      io.Reader
+	OriginalName string
+	Size         int64
+	ContentType  string
 }
 
-func (s *Store) SaveFile(ctx context.Context, file multipart.File, filename string) (*int, error) {
-	name := strconv.FormatInt(time.Now().Unix(), 10) + filepath.Ext(filename)
-	filePath := directory + name
-	if err := saveFile(filePath, file); err != nil {
-		return nil, err
+// saveFile stores the upload under a random name while hashing it and adds
+// its files row in a transaction, in which attach then records what the file
+// belongs to. If a file with the same SHA-256 is already stored, the new copy
+// is removed and the existing file is used instead; the file given to attach
+// and returned still carries the name and type of this upload. If anything
+// fails, the new copy is removed as well, so no stored file is left without
+// its row.
+func (s *Store) saveFile(ctx context.Context, upload NewFile, attach func(tx pgx.Tx, file *File) error) (*File, error) {
+	token, err := randomToken(16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate file name: %v", err)
 	}
+	ext := filepath.Ext(upload.OriginalName)
+	name := token + ext
 
-	sql, _, err := goqu.Insert("files").
-		Rows(goqu.Record{"name": name}).
-		ToSQL()
-	if err != nil {
-		err = os.Remove(filePath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to remove file: %v", err)
-		}
-		return nil, fmt.Errorf("sql query build failed: %v", err)
+	contentType := upload.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(ext)
 	}
 
-	_, err = s.connPool.Exec(ctx, sql)
+	hash := sha256.New()
+	written, err := s.files.Put(ctx, name, io.TeeReader(upload.Content, hash), upload.Size, contentType)
 	if err != nil {
-		err = os.Remove(filePath)
-		if err != nil {
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	file, created, err := s.insertAttachedFile(ctx, &File{
+		Name:         name,
+		OriginalName: upload.OriginalName,
+		Sha256:       &sum,
+		Size:         written,
+		ContentType:  contentType,
+	}, attach)
+	if err != nil || !created {
+		if err := s.files.Delete(ctx, name); err != nil {
 			return nil, fmt.Errorf("failed to remove file: %v", err)
 		}
-		return nil, fmt.Errorf("execute a query failed: %v", err)
 	}
-
-	sql, _, err = goqu.Select("id", "name").
-		From("files").
-		Where(goqu.C("name").Eq(name)).
-		ToSQL()
 	if err != nil {
-		return nil, fmt.Errorf("sql query build failed: %v", err)
+		return nil, err
 	}
 
-	rows, err := s.connPool.Query(ctx, sql)
+	if created {
+		metrics.FilesSaved.Inc()
+		metrics.FilesSavedBytes.Add(float64(written))
+	} else {
+		metrics.FilesDeduplicated.Inc()
+	}
+	return file, nil
+}
+
+func (s *Store) insertAttachedFile(ctx context.Context, file *File, attach func(tx pgx.Tx, file *File) error) (*File, bool, error) {
+	tx, err := s.connPool.Begin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("execute a query failed: %v", err)
+		return nil, false, fmt.Errorf("failed to begin transaction: %v", err)
 	}
-	defer rows.Close()
+	defer tx.Rollback(ctx)
 
-	var files []*File
+	saved, created, err := insertFile(ctx, tx, file)
+	if err != nil {
+		return nil, false, err
+	}
+	saved.OriginalName = file.OriginalName
+	saved.ContentType = file.ContentType
 
-	for rows.Next() {
-		file, err := readFile(rows)
-		if err != nil {
-			return nil, fmt.Errorf("converting failed: %v", err)
-		}
-		files = append(files, file)
+	if err := attach(tx, saved); err != nil {
+		return nil, false, err
 	}
 
-	if len(files) != 0 {
-		return &files[0].Id, nil
+	if err := tx.Commit(ctx); err != nil {
+		return nil, false, fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
-	return nil, fmt.Errorf("failed to get file id: %v", err)
+	return saved, created, nil
 }
 
-func (s *Store) GetFilepath(ctx context.Context, fileId int) (*string, error) {
-	sql, _, err := goqu.Select("id", "name").
+// insertFile adds the files row, or returns the file with the same SHA-256
+// if there is one. The returned bool reports whether the row was created.
+func insertFile(ctx context.Context, q querier, file *File) (*File, bool, error) {
+	sql, _, err := goqu.Insert("files").
+		Rows(goqu.Record{
+			"name":          file.Name,
+			"original_name": file.OriginalName,
+			"sha256":        file.Sha256,
+			"size":          file.Size,
+			"content_type":  file.ContentType,
+		}).
+		OnConflict(goqu.DoNothing()).
+		Returning(fileColumns...).
+		ToSQL()
+	if err != nil {
+		return nil, false, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	created, err := readFile(q.QueryRow(ctx, sql))
+	if err == nil {
+		return created, true, nil
+	}
+	if err != pgx.ErrNoRows {
+		return nil, false, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	sql, _, err = goqu.Select(fileColumns...).
 		From("files").
-		Where(goqu.C("id").Eq(fileId)).
+		Where(goqu.C("sha256").Eq(file.Sha256)).
 		ToSQL()
 	if err != nil {
-		return nil, fmt.Errorf("sql query build failed: %v", err)
+		return nil, false, fmt.Errorf("sql query build failed: %v", err)
 	}
 
-	rows, err := s.connPool.Query(ctx, sql)
+	existing, err := readFile(q.QueryRow(ctx, sql))
 	if err != nil {
-		return nil, fmt.Errorf("execute a query failed: %v", err)
+		return nil, false, fmt.Errorf("execute a query failed: %v", err)
 	}
-	defer rows.Close()
+	return existing, false, nil
+}
 
-	var files []*File
+// OpenFile opens the file for reading from the file storage. The caller must
+// close the reader. It returns ErrNotFound if there is no such file or its
+// content is missing from the storage.
+func (s *Store) OpenFile(ctx context.Context, fileId int) (filestore.Reader, *File, error) {
+	ctx, span := startSpan(ctx, "OpenFile")
+	defer span.End()
 
-	for rows.Next() {
-		file, err := readFile(rows)
-		if err != nil {
-			return nil, fmt.Errorf("converting failed: %v", err)
-		}
-		files = append(files, file)
+	file, err := s.GetFile(ctx, fileId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file == nil {
+		return nil, nil, notFound("file_not_found", "there is no such file")
 	}
 
-	if len(files) != 0 {
-		var filePath = directory + files[0].Name
-		return &filePath, nil
+	content, info, err := s.files.Get(ctx, file.Name)
+	if err == filestore.ErrNotExist {
+		return nil, nil, notFound("file_not_found", "the file content is missing from the storage")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %v", err)
 	}
 
-	return nil, nil
+	// created_at of files uploaded before it was recorded is the migration
+	// time, so the storage knows better when they were written.
+	if file.Sha256 == nil {
+		file.Size = info.Size
+		file.CreatedAt = info.ModTime
+	}
+	return content, file, nil
 }
 
-func saveFile(filePath string, file multipart.File) error {
-	f, err := os.Create(filePath)
+func (s *Store) GetFile(ctx context.Context, fileId int) (*File, error) {
+	ctx, span := startSpan(ctx, "GetFile")
+	defer span.End()
+
+	sql, _, err := goqu.Select(fileColumns...).
+		From("files").
+		Where(goqu.C("id").Eq(fileId)).
+		ToSQL()
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return nil, fmt.Errorf("sql query build failed: %v", err)
 	}
-	defer f.Close()
 
-	_, err = io.Copy(f, file)
+	file, err := readFile(s.connPool.QueryRow(ctx, sql))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+		return nil, fmt.Errorf("execute a query failed: %v", err)
 	}
 
-	return nil
+	return file, nil
 }
 
 func readFile(row pgx.Row) (*File, error) {
 	var f File
+	var size *int64
 
-	err := row.Scan(&f.Id, &f.Name)
+	err := row.Scan(&f.Id, &f.Name, &f.OriginalName, &f.Sha256, &size, &f.ContentType, &f.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
+	if size != nil {
+		f.Size = *size
+	}
 
 	return &f, nil
 }
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// Ping checks that a connection can be acquired from the pool and used.
+func (s *Store) Ping(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "Ping")
+	defer span.End()
+
+	conn, err := s.connPool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	if err := conn.Conn().Ping(ctx); err != nil {
+		return fmt.Errorf("failed to ping database: %v", err)
+	}
+	return nil
+}
+
+// CheckFileStorage checks that uploaded files can be written to the file
+// storage, by writing and removing a probe file.
+func (s *Store) CheckFileStorage(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "CheckFileStorage")
+	defer span.End()
+
+	token, err := randomToken(8)
+	if err != nil {
+		return err
+	}
+	name := ".readyz-" + token
+
+	if _, err := s.files.Put(ctx, name, strings.NewReader("ok"), 2, "text/plain"); err != nil {
+		return fmt.Errorf("file storage is not writable: %v", err)
+	}
+
+	if err := s.files.Delete(ctx, name); err != nil {
+		return fmt.Errorf("failed to remove probe file: %v", err)
+	}
+	return nil
+}
+
+// GetMigrationVersion returns the current goose schema version. It reads the
+// goose history the same way goose does: the newest row for each version
+// decides whether that version is applied.
+func (s *Store) GetMigrationVersion(ctx context.Context) (*int64, error) {
+	ctx, span := startSpan(ctx, "GetMigrationVersion")
+	defer span.End()
+
+	sql, _, err := goqu.Select("version_id", "is_applied").
+		From("goose_db_version").
+		Order(goqu.C("id").Desc()).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := s.connPool.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var seen = map[int64]bool{}
+	for rows.Next() {
+		var version int64
+		var applied bool
+		if err := rows.Scan(&version, &applied); err != nil {
+			return nil, fmt.Errorf("converting failed: %v", err)
+		}
+
+		if seen[version] {
+			continue
+		}
+		seen[version] = true
+
+		if applied {
+			return &version, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	var none int64
+	return &none, nil
+}
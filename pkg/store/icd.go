@@ -0,0 +1,235 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgx/v4"
+)
+
+// Icd10Code is a code of the ICD-10 catalog. Chapters and blocks have range
+// codes such as "E10-E14"; ParentCode is empty for chapters.
+type Icd10Code struct {
+	Code       string  `json:"code"`
+	Title      string  `json:"title"`
+	ParentCode *string `json:"parentCode"`
+}
+
+// icdImportBatch is the number of codes inserted by one statement.
+const icdImportBatch = 1000
+
+// icdSearchLike escapes the LIKE wildcards in a search query.
+var icdSearchLike = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// icdCovers reports whether the ICD-10 code or range of a direction lies
+// within the code or range of an icd_analysis rule. A code covers its
+// subcodes, so the rule "K29" covers "K29.7" and the rule "E10-E14" covers
+// "E11.2" and "E10-E14", but the rule "K29.7" doesn't cover "K29".
+func icdCovers(rule string, code string) bool {
+	ruleFrom, ruleTo := icdBounds(rule)
+	codeFrom, codeTo := icdBounds(code)
+
+	return codeFrom >= ruleFrom && icdAtMost(codeTo, ruleTo)
+}
+
+func icdBounds(code string) (string, string) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if i := strings.Index(code, "-"); i >= 0 {
+		return code[:i], code[i+1:]
+	}
+	return code, code
+}
+
+// icdAtMost reports whether code is at most to or one of its subcodes.
+func icdAtMost(code string, to string) bool {
+	return code <= to || strings.HasPrefix(code, to)
+}
+
+// attachIcdAnalyses adds to the direction every analysis that the current
+// ICD rules require for its ICD code, and records the rule each one came from.
+func attachIcdAnalyses(ctx context.Context, q querier, directionId int, icdCode string) error {
+	ctx, span := startSpan(ctx, "AttachIcdAnalyses")
+	defer span.End()
+
+	sql, _, err := goqu.Select("id", "icd_code", "analysis_id").
+		From("icd_analysis").
+		Where(goqu.C("valid_to").IsNull()).
+		Order(goqu.C("id").Asc()).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := q.Query(ctx, sql)
+	if err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var records []interface{}
+	var seen = map[int]bool{}
+
+	for rows.Next() {
+		var ruleId int
+		var rule string
+		var analysisId int
+		if err := rows.Scan(&ruleId, &rule, &analysisId); err != nil {
+			return fmt.Errorf("read icd analysis failed: %v", err)
+		}
+		if seen[analysisId] || !icdCovers(rule, icdCode) {
+			continue
+		}
+		seen[analysisId] = true
+		records = append(records, goqu.Record{
+			"direction_id": directionId,
+			"analysis_id":  analysisId,
+			"icd_rule_id":  ruleId,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read icd analysis failed: %v", err)
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	sql, _, err = goqu.Insert("direction_analysis").
+		Rows(records...).
+		OnConflict(goqu.DoNothing()).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	if _, err := q.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return nil
+}
+
+// ImportIcd10 adds the codes to the catalog or updates their title and
+// parent, in one transaction. Codes missing from the import are kept, since
+// directions may refer to them.
+func (s *Store) ImportIcd10(ctx context.Context, codes []*Icd10Code) error {
+	ctx, span := startSpan(ctx, "ImportIcd10")
+	defer span.End()
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for start := 0; start < len(codes); start += icdImportBatch {
+		end := start + icdImportBatch
+		if end > len(codes) {
+			end = len(codes)
+		}
+
+		var records = make([]interface{}, 0, end-start)
+		for _, code := range codes[start:end] {
+			records = append(records, goqu.Record{
+				"code":        code.Code,
+				"title":       code.Title,
+				"parent_code": code.ParentCode,
+			})
+		}
+
+		sql, _, err := goqu.Insert("icd10").
+			Rows(records...).
+			OnConflict(goqu.DoUpdate("code", goqu.Record{
+				"title":       goqu.L("EXCLUDED.title"),
+				"parent_code": goqu.L("EXCLUDED.parent_code"),
+			})).
+			ToSQL()
+		if err != nil {
+			return fmt.Errorf("sql query build failed: %v", err)
+		}
+
+		if _, err := tx.Exec(ctx, sql); err != nil {
+			return fmt.Errorf("execute a query failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// SearchIcd10 returns the codes starting with query or with a title that
+// contains it. Code matches come first.
+func (s *Store) SearchIcd10(ctx context.Context, query string, limit int) ([]*Icd10Code, error) {
+	ctx, span := startSpan(ctx, "SearchIcd10")
+	defer span.End()
+
+	var pattern = icdSearchLike.Replace(strings.TrimSpace(query))
+	var codeMatch = goqu.C("code").Like(strings.ToUpper(pattern) + "%")
+
+	sql, _, err := goqu.Select("code", "title", "parent_code").
+		From("icd10").
+		Where(goqu.Or(codeMatch, goqu.C("title").ILike("%"+pattern+"%"))).
+		Order(goqu.L("?", codeMatch).Desc(), goqu.C("code").Asc()).
+		Limit(uint(limit)).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := s.connPool.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var codes []*Icd10Code
+
+	for rows.Next() {
+		code, err := readIcd10Code(rows)
+		if err != nil {
+			return nil, fmt.Errorf("read icd10 code failed: %v", err)
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+// checkIcdCode returns a validation error if the code is not in the ICD-10
+// catalog. Until the catalog has been imported every code is accepted.
+func checkIcdCode(ctx context.Context, q querier, code string) error {
+	sql, _, err := goqu.Select(goqu.L(
+		"EXISTS(?) OR NOT EXISTS(?)",
+		goqu.From("icd10").Select(goqu.L("1")).Where(goqu.C("code").Eq(code)),
+		goqu.From("icd10").Select(goqu.L("1")),
+	)).ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var known bool
+	if err := q.QueryRow(ctx, sql).Scan(&known); err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+	if !known {
+		return invalid("icd_code", "is not in the ICD-10 catalog")
+	}
+
+	return nil
+}
+
+func readIcd10Code(row pgx.Row) (*Icd10Code, error) {
+	var c Icd10Code
+
+	err := row.Scan(&c.Code, &c.Title, &c.ParentCode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
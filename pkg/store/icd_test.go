@@ -0,0 +1,45 @@
+package store
+
+import "testing"
+
+func TestIcdCovers(t *testing.T) {
+	tests := []struct {
+		rule string
+		code string
+		want bool
+	}{
+		{rule: "K29", code: "K29", want: true},
+		{rule: "K29", code: "K29.7", want: true},
+		{rule: "K29", code: "K29.70", want: true},
+		{rule: "K29", code: "K30", want: false},
+		{rule: "K29", code: "K28.9", want: false},
+		{rule: "K29.7", code: "K29.7", want: true},
+		{rule: "K29.7", code: "K29", want: false},
+		{rule: "K29.7", code: "K29.6", want: false},
+		{rule: "K29.7", code: "K29.8", want: false},
+
+		{rule: "E10-E14", code: "E10", want: true},
+		{rule: "E10-E14", code: "E11.2", want: true},
+		{rule: "E10-E14", code: "E14", want: true},
+		{rule: "E10-E14", code: "E14.9", want: true},
+		{rule: "E10-E14", code: "E09.9", want: false},
+		{rule: "E10-E14", code: "E15", want: false},
+		{rule: "E10-E14", code: "E10-E14", want: true},
+		{rule: "E10-E14", code: "E11-E13", want: true},
+		{rule: "E10-E14", code: "E12-E15", want: false},
+		{rule: "E10-E14", code: "E09-E11", want: false},
+		{rule: "E10", code: "E10-E14", want: false},
+		{rule: "E10-E14", code: "F10", want: false},
+		{rule: "A00-B99", code: "B20.1", want: true},
+
+		{rule: "K29", code: "k29.7", want: true},
+		{rule: "k29", code: " K29.7 ", want: true},
+		{rule: "E10-E14", code: "e11.2", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := icdCovers(tt.rule, tt.code); got != tt.want {
+			t.Errorf("icdCovers(%q, %q) = %v, want %v", tt.rule, tt.code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgx/v4"
+)
+
+// InviteRoles lists the roles that can only be obtained through an invite.
+var InviteRoles = map[string]bool{
+	"registrar": true,
+	"doctor":    true,
+	"admin":     true,
+}
+
+type Invite struct {
+	Id           int        `json:"id"`
+	Code         string     `json:"code,omitempty"`
+	Organization string     `json:"organization"`
+	Role         string     `json:"role"`
+	DoctorId     *int       `json:"doctorId"`
+	CreatedBy    *int       `json:"createdBy"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	ExpiresAt    time.Time  `json:"expiresAt"`
+	RevokedAt    *time.Time `json:"revokedAt"`
+	UsedAt       *time.Time `json:"usedAt"`
+	UsedBy       *string    `json:"usedBy"`
+}
+
+// NewInvite describes an invite to create. DoctorId is required for the
+// doctor role and links the new account to the doctor's directions.
+type NewInvite struct {
+	Organization string    `json:"organization"`
+	Role         string    `json:"role"`
+	DoctorId     *int      `json:"doctor_id"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// CreateInvite stores a new single-use invite. Only a digest of the code is
+// kept, so the returned Code is the only time it is available in plain text.
+func (s *Store) CreateInvite(ctx context.Context, invite NewInvite, createdBy *int) (*Invite, error) {
+	ctx, span := startSpan(ctx, "CreateInvite")
+	defer span.End()
+
+	if !InviteRoles[invite.Role] {
+		return nil, invalid("role", "can not be assigned by invite")
+	}
+	if (invite.Role == "doctor") != (invite.DoctorId != nil) {
+		return nil, invalid("doctor_id", "must be set for doctor invites only")
+	}
+
+	code, err := randomToken(12)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate invite code: %v", err)
+	}
+
+	sql, _, err := goqu.Insert("invites").
+		Rows(goqu.Record{
+			"code_hash":    hashToken(code),
+			"organization": invite.Organization,
+			"role":         invite.Role,
+			"related_id":   invite.DoctorId,
+			"created_by":   createdBy,
+			"expires_at":   invite.ExpiresAt,
+		}).
+		Returning("id", "created_at").
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	newInvite := &Invite{
+		Code:         code,
+		Organization: invite.Organization,
+		Role:         invite.Role,
+		DoctorId:     invite.DoctorId,
+		CreatedBy:    createdBy,
+		ExpiresAt:    invite.ExpiresAt,
+	}
+	if err := s.connPool.QueryRow(ctx, sql).Scan(&newInvite.Id, &newInvite.CreatedAt); err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return newInvite, nil
+}
+
+func (s *Store) GetInvites(ctx context.Context) ([]*Invite, error) {
+	ctx, span := startSpan(ctx, "GetInvites")
+	defer span.End()
+
+	sql, _, err := goqu.Select(
+		"invites.id", "invites.organization", "invites.role", "related_id", "created_by", "created_at",
+		"expires_at", "revoked_at", "invites.used_at", "username",
+	).
+		From("invites").
+		LeftJoin(
+			goqu.T("invite_uses"),
+			goqu.On(goqu.Ex{
+				"invite_uses.invite_id": goqu.I("invites.id"),
+			}),
+		).
+		LeftJoin(
+			goqu.T("users"),
+			goqu.On(goqu.Ex{
+				"users.id": goqu.I("invite_uses.user_id"),
+			}),
+		).
+		Order(goqu.I("invites.created_at").Desc()).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := s.connPool.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var invites []*Invite
+
+	for rows.Next() {
+		invite, err := readInvite(rows)
+		if err != nil {
+			return nil, fmt.Errorf("read invite failed: %v", err)
+		}
+		invites = append(invites, invite)
+	}
+
+	return invites, nil
+}
+
+// RevokeInvite revokes an unused invite. It returns ErrNotFound if there is no
+// such invite or it was already used or revoked.
+func (s *Store) RevokeInvite(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "RevokeInvite")
+	defer span.End()
+
+	sql, _, err := goqu.Update("invites").
+		Set(goqu.Record{"revoked_at": goqu.L("now()")}).
+		Where(
+			goqu.C("id").Eq(id),
+			goqu.C("used_at").IsNull(),
+			goqu.C("revoked_at").IsNull(),
+		).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	tag, err := s.connPool.Exec(ctx, sql)
+	if err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return notFound("invite_not_found", "there is no such unused invite")
+	}
+	return nil
+}
+
+// RegisterWithInvite consumes the invite and creates the user in a single
+// transaction. It returns ErrNotFound if the code is unknown, expired, revoked
+// or was already used, and ErrConflict if the username is taken.
+func (s *Store) RegisterWithInvite(ctx context.Context, code string, username string, password string, remoteAddr string) (*User, error) {
+	ctx, span := startSpan(ctx, "RegisterWithInvite")
+	defer span.End()
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql, _, err := goqu.Update("invites").
+		Set(goqu.Record{"used_at": goqu.L("now()")}).
+		Where(
+			goqu.C("code_hash").Eq(hashToken(code)),
+			goqu.C("used_at").IsNull(),
+			goqu.C("revoked_at").IsNull(),
+			goqu.C("expires_at").Gt(goqu.L("now()")),
+		).
+		Returning("id", "role", "organization", "related_id").
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var inviteId int
+	var user = User{Username: username, Password: hash}
+	err = tx.QueryRow(ctx, sql).Scan(&inviteId, &user.Role, &user.Organization, &user.RelatedId)
+	if err == pgx.ErrNoRows {
+		return nil, notFound("invite_not_found", "invite code is invalid, expired or already used")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	sql, _, err = goqu.Insert("users").
+		Rows(goqu.Record{
+			"username":     user.Username,
+			"password":     user.Password,
+			"role":         user.Role,
+			"id_related":   user.RelatedId,
+			"organization": user.Organization,
+		}).
+		Returning("id").
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+	if err := tx.QueryRow(ctx, sql).Scan(&user.Id); err != nil {
+		if isUniqueViolation(err) {
+			return nil, conflict("username_taken", "user already exists")
+		}
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	sql, _, err = goqu.Insert("invite_uses").
+		Rows(goqu.Record{
+			"invite_id":   inviteId,
+			"user_id":     user.Id,
+			"remote_addr": remoteAddr,
+		}).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return &user, nil
+}
+
+func readInvite(row pgx.Row) (*Invite, error) {
+	var i Invite
+
+	err := row.Scan(
+		&i.Id, &i.Organization, &i.Role, &i.DoctorId, &i.CreatedBy, &i.CreatedAt,
+		&i.ExpiresAt, &i.RevokedAt, &i.UsedAt, &i.UsedBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
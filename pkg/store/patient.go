@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -27,6 +28,9 @@ type NewPatient struct {
 }
 
 func (s *Store) GetPatient(ctx context.Context, lastName string, policyNumber string) (*Patient, error) {
+	ctx, span := startSpan(ctx, "GetPatient")
+	defer span.End()
+
 	sql, _, err := goqu.Select("id", "first_name", "last_name", "birth_date", "policy_number", "tel").
 		From("patient").
 		Where(goqu.C("last_name").Eq(lastName), goqu.C("policy_number").Eq(policyNumber)).
@@ -57,7 +61,28 @@ func (s *Store) GetPatient(ctx context.Context, lastName string, policyNumber st
 	return patients[0], nil
 }
 
-func (s *Store) AddPatient(ctx context.Context, patient NewPatient) (*int, error) {
+// addPatient adds the patient unless one with the same policy number exists,
+// and returns its id and whether it was created. A policy number in the legacy
+// format is only accepted if a patient already has it.
+func addPatient(ctx context.Context, q querier, patient NewPatient) (int, bool, error) {
+	ctx, span := startSpan(ctx, "AddPatient")
+	defer span.End()
+
+	if err := patient.Validate(); err != nil {
+		return 0, false, err
+	}
+
+	if !policyNumberPattern.MatchString(patient.PolicyNumber) {
+		id, found, err := matchPatient(ctx, q, patient)
+		if err != nil {
+			return 0, false, err
+		}
+		if !found {
+			return 0, false, invalid("policy_number", "must be 16 digits")
+		}
+		return id, false, nil
+	}
+
 	sql, _, err := goqu.Insert("patient").
 		Rows(goqu.Record{
 			"first_name":    patient.FirstName,
@@ -67,20 +92,64 @@ func (s *Store) AddPatient(ctx context.Context, patient NewPatient) (*int, error
 			"tel":           patient.Tel,
 		}).
 		OnConflict(goqu.DoNothing()).
+		Returning("id").
 		ToSQL()
 	if err != nil {
-		return nil, fmt.Errorf("sql query build failed: %v", err)
+		return 0, false, fmt.Errorf("sql query build failed: %v", err)
 	}
-	if _, err := s.connPool.Exec(ctx, sql); err != nil {
-		return nil, fmt.Errorf("execute a query failed: %v", err)
+
+	var id int
+	err = q.QueryRow(ctx, sql).Scan(&id)
+	if err == nil {
+		return id, true, nil
+	}
+	if err != pgx.ErrNoRows {
+		return 0, false, fmt.Errorf("execute a query failed: %v", err)
 	}
 
-	newPatient, err := s.GetPatient(context.Background(), patient.LastName, patient.PolicyNumber)
+	id, found, err := matchPatient(ctx, q, patient)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get patient: %v\n", err)
+		return 0, false, err
+	}
+	if !found {
+		return 0, false, errors.New("the conflicting patient was not found")
+	}
+	return id, false, nil
+}
+
+// matchPatient finds the patient with the policy number and reports whether
+// there is one. It returns ErrConflict if that patient has another name or
+// birth date, which usually means a mistyped policy number.
+func matchPatient(ctx context.Context, q querier, patient NewPatient) (int, bool, error) {
+	// Compare the birth date in SQL, so that it is converted to a date the
+	// same way as when the patient was inserted.
+	sql, _, err := goqu.Select("id", goqu.L("lower(?) = lower(?) AND lower(?) = lower(?) AND ?",
+		goqu.C("first_name"), patient.FirstName,
+		goqu.C("last_name"), patient.LastName,
+		goqu.C("birth_date").Eq(patient.BirthDate),
+	)).
+		From("patient").
+		Where(goqu.C("policy_number").Eq(patient.PolicyNumber)).
+		ToSQL()
+	if err != nil {
+		return 0, false, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var id int
+	var same bool
+	err = q.QueryRow(ctx, sql).Scan(&id, &same)
+	if err == pgx.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("execute a query failed: %v", err)
+	}
+	if !same {
+		return 0, false, conflict("patient_mismatch",
+			"a patient with another name or birth date already has this policy number")
 	}
 
-	return &newPatient.Id, nil
+	return id, true, nil
 }
 
 func readPatient(row pgx.Row) (*Patient, error) {
@@ -0,0 +1,230 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/jackc/pgx/v4"
+)
+
+// Session groups the refresh tokens issued since a single login. Every refresh
+// rotates the token but keeps the session id, so revoking a session ends all of
+// its tokens at once.
+type Session struct {
+	Id           string `json:"session_id"`
+	UserId       int    `json:"user_id"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshToken struct {
+	Id        int
+	UserId    int
+	SessionId string
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+func (s *Store) CreateSession(ctx context.Context, userId int, expiresAt time.Time) (*Session, error) {
+	ctx, span := startSpan(ctx, "CreateSession")
+	defer span.End()
+
+	sessionId, err := randomToken(16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session id: %v", err)
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %v", err)
+	}
+
+	sql, _, err := insertRefreshToken(userId, sessionId, token, expiresAt).ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+	if _, err := s.connPool.Exec(ctx, sql); err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return &Session{Id: sessionId, UserId: userId, RefreshToken: token}, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one within the same
+// session. It returns nil if the token is unknown, expired or already used.
+// Presenting a token that was already rotated revokes the whole session, since
+// it means the token has leaked.
+func (s *Store) RotateRefreshToken(ctx context.Context, token string, expiresAt time.Time) (*Session, error) {
+	ctx, span := startSpan(ctx, "RotateRefreshToken")
+	defer span.End()
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql, _, err := goqu.Select("id", "user_id", "session_id", "expires_at", "revoked_at").
+		From("refresh_tokens").
+		Where(goqu.C("token_hash").Eq(hashToken(token))).
+		ForUpdate(exp.Wait).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	current, err := readRefreshToken(tx.QueryRow(ctx, sql))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read refresh token failed: %v", err)
+	}
+
+	if current.RevokedAt != nil {
+		if err := revokeSession(ctx, tx, current.SessionId); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %v", err)
+		}
+		return nil, nil
+	}
+
+	if current.ExpiresAt.Before(time.Now()) {
+		return nil, nil
+	}
+
+	sql, _, err = goqu.Update("refresh_tokens").
+		Set(goqu.Record{"revoked_at": goqu.L("now()")}).
+		Where(goqu.C("id").Eq(current.Id)).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	newToken, err := randomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %v", err)
+	}
+
+	sql, _, err = insertRefreshToken(current.UserId, current.SessionId, newToken, expiresAt).ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return &Session{Id: current.SessionId, UserId: current.UserId, RefreshToken: newToken}, nil
+}
+
+func (s *Store) RevokeSession(ctx context.Context, sessionId string) error {
+	ctx, span := startSpan(ctx, "RevokeSession")
+	defer span.End()
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := revokeSession(ctx, tx, sessionId); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// IsSessionActive reports whether the session still has a refresh token that
+// is neither revoked nor expired.
+func (s *Store) IsSessionActive(ctx context.Context, sessionId string) (*bool, error) {
+	ctx, span := startSpan(ctx, "IsSessionActive")
+	defer span.End()
+
+	sql, _, err := goqu.Select(goqu.COUNT("id")).
+		From("refresh_tokens").
+		Where(
+			goqu.C("session_id").Eq(sessionId),
+			goqu.C("revoked_at").IsNull(),
+			goqu.C("expires_at").Gt(goqu.L("now()")),
+		).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var count int
+	if err := s.connPool.QueryRow(ctx, sql).Scan(&count); err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	var cond = count != 0
+	return &cond, nil
+}
+
+func revokeSession(ctx context.Context, tx pgx.Tx, sessionId string) error {
+	sql, _, err := goqu.Update("refresh_tokens").
+		Set(goqu.Record{"revoked_at": goqu.L("now()")}).
+		Where(goqu.C("session_id").Eq(sessionId), goqu.C("revoked_at").IsNull()).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+	return nil
+}
+
+func insertRefreshToken(userId int, sessionId string, token string, expiresAt time.Time) *goqu.InsertDataset {
+	return goqu.Insert("refresh_tokens").
+		Rows(goqu.Record{
+			"user_id":    userId,
+			"session_id": sessionId,
+			"token_hash": hashToken(token),
+			"expires_at": expiresAt,
+		})
+}
+
+// hashToken is used for secrets that are looked up by value, so only their
+// digest is stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func readRefreshToken(row pgx.Row) (*refreshToken, error) {
+	var t refreshToken
+
+	err := row.Scan(&t.Id, &t.UserId, &t.SessionId, &t.ExpiresAt, &t.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
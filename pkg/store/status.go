@@ -0,0 +1,251 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/JulianaOsi/medhelp/pkg/metrics"
+)
+
+type DirectionStatus string
+
+const (
+	StatusNew              DirectionStatus = "new"
+	StatusAwaitingAnalyses DirectionStatus = "awaiting_analyses"
+	StatusUnderReview      DirectionStatus = "under_review"
+	StatusApproved         DirectionStatus = "approved"
+	StatusRejected         DirectionStatus = "rejected"
+	StatusCancelled        DirectionStatus = "cancelled"
+	StatusCompleted        DirectionStatus = "completed"
+)
+
+// statusTransitions lists the statuses a direction may move to from each
+// status. A direction never goes back to new, and cancelled and completed
+// directions are final. Until a direction is approved, reviews may move it
+// back and forth, since a registrar can change their verdict on an analysis;
+// an approved direction is closed and can only be completed or cancelled.
+var statusTransitions = map[DirectionStatus][]DirectionStatus{
+	StatusNew:              {StatusAwaitingAnalyses, StatusUnderReview, StatusRejected, StatusCancelled},
+	StatusAwaitingAnalyses: {StatusUnderReview, StatusApproved, StatusRejected, StatusCancelled},
+	StatusUnderReview:      {StatusAwaitingAnalyses, StatusApproved, StatusRejected, StatusCancelled},
+	StatusRejected:         {StatusAwaitingAnalyses, StatusUnderReview, StatusApproved, StatusCancelled},
+	StatusApproved:         {StatusCompleted, StatusCancelled},
+	StatusCancelled:        {},
+	StatusCompleted:        {},
+}
+
+// Valid reports whether s is one of the known statuses.
+func (s DirectionStatus) Valid() bool {
+	_, ok := statusTransitions[s]
+	return ok
+}
+
+// Closed reports whether the direction has been decided on, so uploads and
+// reviews of its analyses may no longer change its status.
+func (s DirectionStatus) Closed() bool {
+	return s == StatusApproved || s == StatusCancelled || s == StatusCompleted
+}
+
+// CanTransition reports whether a direction may move from s to the status.
+func (s DirectionStatus) CanTransition(to DirectionStatus) bool {
+	for _, next := range statusTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusChange is a status a direction is moved to, by whom and why.
+type StatusChange struct {
+	Status    DirectionStatus `json:"status"`
+	ChangedBy *int            `json:"-"`
+	Reason    string          `json:"reason"`
+}
+
+func (c StatusChange) Validate() error {
+	var errs ValidationError
+
+	if !c.Status.Valid() {
+		errs.Add("status", "is not a known direction status")
+	}
+	if (c.Status == StatusRejected || c.Status == StatusCancelled) && c.Reason == "" {
+		errs.Add("reason", "is required when a direction is rejected or cancelled")
+	}
+
+	return errs.Err()
+}
+
+// StatusHistoryEntry is one recorded status change. From is empty for the
+// status a direction was created with.
+type StatusHistoryEntry struct {
+	Id                int              `json:"id"`
+	DirectionId       int              `json:"directionId"`
+	From              *DirectionStatus `json:"from"`
+	To                DirectionStatus  `json:"to"`
+	ChangedBy         *int             `json:"changedBy"`
+	ChangedByUsername *string          `json:"changedByUsername"`
+	ChangedAt         time.Time        `json:"changedAt"`
+	Reason            string           `json:"reason"`
+}
+
+// SetDirectionStatus moves the direction to a new status and records the
+// change. It returns ErrConflict if the transition isn't allowed.
+func (s *Store) SetDirectionStatus(ctx context.Context, directionId int, change StatusChange) error {
+	ctx, span := startSpan(ctx, "SetDirectionStatus")
+	defer span.End()
+
+	if err := change.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	previous, err := moveDirectionStatus(ctx, tx, directionId, change)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	countStatusChange(previous, change.Status)
+	return nil
+}
+
+// moveDirectionStatus locks the direction, moves it to the new status and
+// records the change, returning the previous status. It returns ErrConflict
+// if the transition isn't allowed.
+func moveDirectionStatus(ctx context.Context, q querier, directionId int, change StatusChange) (*DirectionStatus, error) {
+	sql, _, err := goqu.Select("status").
+		From("direction").
+		Where(goqu.C("id").Eq(directionId)).
+		ForUpdate(exp.Wait).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	var previous DirectionStatus
+	err = q.QueryRow(ctx, sql).Scan(&previous)
+	if err == pgx.ErrNoRows {
+		return nil, notFound("direction_not_found", "there is no such direction")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	if !previous.CanTransition(change.Status) {
+		return nil, conflict("illegal_status_transition",
+			fmt.Sprintf("a direction can't move from %s to %s", previous, change.Status))
+	}
+
+	sql, _, err = goqu.Update("direction").
+		Set(goqu.Record{"status": change.Status}).
+		Where(goqu.C("id").Eq(directionId)).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	if _, err := q.Exec(ctx, sql); err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	if err := recordStatusChange(ctx, q, directionId, &previous, change); err != nil {
+		return nil, err
+	}
+
+	return &previous, nil
+}
+
+// countStatusChange counts a committed status change, if there was one.
+func countStatusChange(previous *DirectionStatus, to DirectionStatus) {
+	if previous != nil {
+		metrics.DirectionStatusTransitions.WithLabelValues(string(*previous), string(to)).Inc()
+	}
+}
+
+func recordStatusChange(ctx context.Context, q querier, directionId int, from *DirectionStatus, change StatusChange) error {
+	sql, _, err := goqu.Insert("direction_status_history").
+		Rows(goqu.Record{
+			"direction_id": directionId,
+			"from_status":  from,
+			"to_status":    change.Status,
+			"changed_by":   change.ChangedBy,
+			"reason":       change.Reason,
+		}).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	if _, err := q.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+	return nil
+}
+
+// GetDirectionStatusHistory returns the status changes of the direction,
+// oldest first.
+func (s *Store) GetDirectionStatusHistory(ctx context.Context, directionId int) ([]*StatusHistoryEntry, error) {
+	ctx, span := startSpan(ctx, "GetDirectionStatusHistory")
+	defer span.End()
+
+	sql, _, err := goqu.Select(
+		"direction_status_history.id", "direction_id", "from_status", "to_status", "changed_by", "username",
+		"changed_at", "reason",
+	).
+		From("direction_status_history").
+		LeftJoin(
+			goqu.T("users"),
+			goqu.On(goqu.Ex{
+				"users.id": goqu.I("direction_status_history.changed_by"),
+			}),
+		).
+		Where(goqu.C("direction_id").Eq(directionId)).
+		Order(goqu.C("changed_at").Asc(), goqu.I("direction_status_history.id").Asc()).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := s.connPool.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var history []*StatusHistoryEntry
+
+	for rows.Next() {
+		entry, err := readStatusHistoryEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("read status history failed: %v", err)
+		}
+		history = append(history, entry)
+	}
+
+	return history, nil
+}
+
+func readStatusHistoryEntry(row pgx.Row) (*StatusHistoryEntry, error) {
+	var e StatusHistoryEntry
+
+	err := row.Scan(&e.Id, &e.DirectionId, &e.From, &e.To, &e.ChangedBy, &e.ChangedByUsername, &e.ChangedAt, &e.Reason)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
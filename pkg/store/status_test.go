@@ -0,0 +1,127 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+var statuses = []DirectionStatus{
+	StatusNew, StatusAwaitingAnalyses, StatusUnderReview, StatusApproved, StatusRejected, StatusCancelled,
+	StatusCompleted,
+}
+
+func TestCanTransition(t *testing.T) {
+	type transition struct {
+		from DirectionStatus
+		to   DirectionStatus
+	}
+
+	// allowed lists every legal transition; all others must be refused.
+	allowed := map[transition]bool{
+		{StatusNew, StatusAwaitingAnalyses}: true,
+		{StatusNew, StatusUnderReview}:      true,
+		{StatusNew, StatusRejected}:         true,
+		{StatusNew, StatusCancelled}:        true,
+
+		{StatusAwaitingAnalyses, StatusUnderReview}: true,
+		{StatusAwaitingAnalyses, StatusApproved}:    true,
+		{StatusAwaitingAnalyses, StatusRejected}:    true,
+		{StatusAwaitingAnalyses, StatusCancelled}:   true,
+
+		{StatusUnderReview, StatusAwaitingAnalyses}: true,
+		{StatusUnderReview, StatusApproved}:         true,
+		{StatusUnderReview, StatusRejected}:         true,
+		{StatusUnderReview, StatusCancelled}:        true,
+
+		{StatusRejected, StatusAwaitingAnalyses}: true,
+		{StatusRejected, StatusUnderReview}:      true,
+		{StatusRejected, StatusApproved}:         true,
+		{StatusRejected, StatusCancelled}:        true,
+
+		{StatusApproved, StatusCompleted}: true,
+		{StatusApproved, StatusCancelled}: true,
+	}
+
+	for _, from := range append(statuses, "unknown") {
+		for _, to := range append(statuses, "unknown") {
+			want := allowed[transition{from, to}]
+			if got := from.CanTransition(to); got != want {
+				t.Errorf("%s -> %s allowed = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestDirectionStatus(t *testing.T) {
+	tests := []struct {
+		status DirectionStatus
+		valid  bool
+		closed bool
+	}{
+		{StatusNew, true, false},
+		{StatusAwaitingAnalyses, true, false},
+		{StatusUnderReview, true, false},
+		{StatusRejected, true, false},
+		{StatusApproved, true, true},
+		{StatusCancelled, true, true},
+		{StatusCompleted, true, true},
+		{"", false, false},
+		{"Approved", false, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.status.Valid(); got != tt.valid {
+			t.Errorf("%q.Valid() = %v, want %v", tt.status, got, tt.valid)
+		}
+		if got := tt.status.Closed(); got != tt.closed {
+			t.Errorf("%q.Closed() = %v, want %v", tt.status, got, tt.closed)
+		}
+	}
+}
+
+func TestStatusChangeValidate(t *testing.T) {
+	tests := []struct {
+		change StatusChange
+		fields []string
+	}{
+		{StatusChange{Status: StatusUnderReview}, nil},
+		{StatusChange{Status: StatusCompleted}, nil},
+		{StatusChange{Status: StatusRejected, Reason: "contraindicated"}, nil},
+		{StatusChange{Status: StatusRejected}, []string{"reason"}},
+		{StatusChange{Status: StatusCancelled}, []string{"reason"}},
+		{StatusChange{Status: "done", Reason: "finished"}, []string{"status"}},
+		{StatusChange{}, []string{"status"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s", tt.change.Status, tt.change.Reason), func(t *testing.T) {
+			checkFields(t, tt.change.Validate(), tt.fields)
+		})
+	}
+}
+
+// checkFields fails the test unless err is a validation error of exactly the
+// fields, or nil if there are none.
+func checkFields(t *testing.T, err error, fields []string) {
+	t.Helper()
+
+	if len(fields) == 0 {
+		if err != nil {
+			t.Errorf("validation failed: %v", err)
+		}
+		return
+	}
+
+	errs, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("got %v, want a validation error of %v", err, fields)
+	}
+
+	var got []string
+	for _, f := range errs.Fields {
+		got = append(got, f.Field)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(fields) {
+		t.Errorf("invalid fields = %v, want %v", got, fields)
+	}
+}
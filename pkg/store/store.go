@@ -3,33 +3,71 @@ package store
 import (
 	"context"
 	"fmt"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+
+	"github.com/JulianaOsi/medhelp/pkg/filestore"
+	"github.com/JulianaOsi/medhelp/pkg/logging"
 )
 
 var DB *Store
 
 type Store struct {
-	connPool *pgxpool.Pool
+	connPool tracedPool
+	files    filestore.FileStorage
+}
+
+// querier runs statements either on the pool or in a transaction, so the same
+// query can be part of a larger transaction.
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
 }
 
 type ConfigDB struct {
-	Host     string
-	Port     string
-	Name     string
-	User     string
-	Password string
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Name     string `yaml:"name"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
 }
 
-func InitDB(config *ConfigDB) error {
-	pool, err := pgxpool.Connect(context.Background(), config.ToString())
+func InitDB(config *ConfigDB, storage *filestore.Config) error {
+	files, err := filestore.New(context.Background(), storage)
+	if err != nil {
+		return fmt.Errorf("failed to set up file storage: %v", err)
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(config.ToString())
 	if err != nil {
 		return err
 	}
+	poolConfig.ConnConfig.Logger = logging.PgxLogger{}
+	poolConfig.ConnConfig.LogLevel = logging.PgxLevel(logrus.GetLevel())
 
-	DB = &Store{connPool: pool}
+	pool, err := pgxpool.ConnectConfig(context.Background(), poolConfig)
+	if err != nil {
+		return err
+	}
+
+	DB = &Store{connPool: tracedPool{Pool: pool}, files: files}
 	return nil
 }
 
+// Stat returns the connection pool statistics.
+func (s *Store) Stat() *pgxpool.Stat {
+	return s.connPool.Stat()
+}
+
+// Close waits for acquired connections to be released and closes the pool.
+func (s *Store) Close() {
+	s.connPool.Close()
+}
+
 func (c *ConfigDB) ToString() string {
 	if c.Password != "" {
 		return fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=disable search_path=public",
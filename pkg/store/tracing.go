@@ -0,0 +1,164 @@
+package store
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/JulianaOsi/medhelp/pkg/logging"
+)
+
+var tracer = otel.Tracer("github.com/JulianaOsi/medhelp/pkg/store")
+
+// startSpan starts the span of a Store method.
+func startSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "store."+method)
+}
+
+// startQuerySpan starts a span for one statement. The statement is recorded
+// with its literals masked, since goqu inlines patient data into it.
+func startQuerySpan(ctx context.Context, sql string) (context.Context, trace.Span) {
+	var operation = "query"
+	if fields := strings.Fields(sql); len(fields) > 0 {
+		operation = strings.ToUpper(fields[0])
+	}
+
+	return tracer.Start(ctx, "db."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationKey.String(operation),
+			semconv.DBStatementKey.String(logging.RedactSQL(sql)),
+		),
+	)
+}
+
+func endQuerySpan(span trace.Span, err error) {
+	if err != nil && err != pgx.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedPool is a pgxpool.Pool that traces every statement, including the
+// ones run in transactions it begins.
+type tracedPool struct {
+	*pgxpool.Pool
+}
+
+func (p tracedPool) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	ctx, span := startQuerySpan(ctx, sql)
+	tag, err := p.Pool.Exec(ctx, sql, args...)
+	endQuerySpan(span, err)
+	return tag, err
+}
+
+func (p tracedPool) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, span := startQuerySpan(ctx, sql)
+	rows, err := p.Pool.Query(ctx, sql, args...)
+	return traceRows(span, rows, err)
+}
+
+func (p tracedPool) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	ctx, span := startQuerySpan(ctx, sql)
+	return tracedRow{Row: p.Pool.QueryRow(ctx, sql, args...), span: span}
+}
+
+func (p tracedPool) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := p.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tracedTx{Tx: tx}, nil
+}
+
+type tracedTx struct {
+	pgx.Tx
+}
+
+// Begin starts a savepoint inside the transaction.
+func (t tracedTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := t.Tx.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tracedTx{Tx: tx}, nil
+}
+
+func (t tracedTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	ctx, span := startQuerySpan(ctx, sql)
+	tag, err := t.Tx.Exec(ctx, sql, args...)
+	endQuerySpan(span, err)
+	return tag, err
+}
+
+func (t tracedTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, span := startQuerySpan(ctx, sql)
+	rows, err := t.Tx.Query(ctx, sql, args...)
+	return traceRows(span, rows, err)
+}
+
+func (t tracedTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	ctx, span := startQuerySpan(ctx, sql)
+	return tracedRow{Row: t.Tx.QueryRow(ctx, sql, args...), span: span}
+}
+
+// tracedRow ends the statement span once the row has been scanned, which is
+// when QueryRow reports its error.
+type tracedRow struct {
+	pgx.Row
+	span trace.Span
+}
+
+func (r tracedRow) Scan(dest ...interface{}) error {
+	err := r.Row.Scan(dest...)
+	endQuerySpan(r.span, err)
+	return err
+}
+
+// traceRows leaves the statement span open until the rows have been read,
+// unless the query failed right away.
+func traceRows(span trace.Span, rows pgx.Rows, err error) (pgx.Rows, error) {
+	if err != nil {
+		endQuerySpan(span, err)
+		return rows, err
+	}
+	return &tracedRows{Rows: rows, span: span}, nil
+}
+
+// tracedRows ends the statement span when the rows are closed, either by the
+// caller or by reading past the last one, so the span covers fetching them
+// and records the error that stopped it.
+type tracedRows struct {
+	pgx.Rows
+	span  trace.Span
+	ended bool
+}
+
+func (r *tracedRows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	r.end()
+	return false
+}
+
+func (r *tracedRows) Close() {
+	r.Rows.Close()
+	r.end()
+}
+
+func (r *tracedRows) end() {
+	if !r.ended {
+		r.ended = true
+		endQuerySpan(r.span, r.Rows.Err())
+	}
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+var (
+	recorder     = tracetest.NewSpanRecorder()
+	recorderOnce sync.Once
+)
+
+// recordSpans makes the tracer of the package record into a stand-in for a
+// collector and returns the spans ended since then. The tracer delegates to
+// the first provider set only, so every test shares the recorder.
+func recordSpans() func() []sdktrace.ReadOnlySpan {
+	recorderOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	})
+
+	start := len(recorder.Ended())
+	return func() []sdktrace.ReadOnlySpan {
+		return recorder.Ended()[start:]
+	}
+}
+
+// fakeRows yields count rows and then fails with err.
+type fakeRows struct {
+	pgx.Rows
+	count  int
+	err    error
+	closed bool
+}
+
+func (r *fakeRows) Next() bool {
+	if r.closed || r.count == 0 {
+		r.closed = true
+		return false
+	}
+	r.count--
+	return true
+}
+
+func (r *fakeRows) Close()     { r.closed = true }
+func (r *fakeRows) Err() error { return r.err }
+
+func TestTracedRows(t *testing.T) {
+	errFetch := errors.New("connection lost while fetching")
+
+	tests := []struct {
+		name     string
+		queryErr error
+		rows     int
+		fetchErr error
+		// read is how many rows are read before Close; -1 reads them all.
+		read       int
+		wantStatus codes.Code
+		wantEvents int
+	}{
+		{name: "all rows read", rows: 3, read: -1, wantStatus: codes.Unset},
+		{name: "closed early", rows: 3, read: 1, wantStatus: codes.Unset},
+		{name: "no rows", rows: 0, read: -1, wantStatus: codes.Unset},
+		{name: "fetch failed", rows: 2, fetchErr: errFetch, read: -1, wantStatus: codes.Error, wantEvents: 1},
+		{name: "query failed", queryErr: errFetch, wantStatus: codes.Error, wantEvents: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ended := recordSpans()
+
+			_, span := startQuerySpan(context.Background(), "SELECT * FROM patient WHERE name = 'Ivanov'")
+			rows, err := traceRows(span, &fakeRows{count: tt.rows, err: tt.fetchErr}, tt.queryErr)
+			if err != tt.queryErr {
+				t.Fatalf("traceRows returned %v, want %v", err, tt.queryErr)
+			}
+
+			if err == nil {
+				if len(ended()) != 0 {
+					t.Fatal("span ended before the rows were read")
+				}
+
+				for read := 0; (tt.read < 0 || read < tt.read) && rows.Next(); read++ {
+				}
+				rows.Close()
+				rows.Close()
+			}
+
+			spans := ended()
+			if len(spans) != 1 {
+				t.Fatalf("%d spans ended, want 1", len(spans))
+			}
+			if got := spans[0].Status().Code; got != tt.wantStatus {
+				t.Errorf("span status = %v, want %v", got, tt.wantStatus)
+			}
+			if got := len(spans[0].Events()); got != tt.wantEvents {
+				t.Errorf("span has %d events, want %d", got, tt.wantEvents)
+			}
+
+			for _, attr := range spans[0].Attributes() {
+				if attr.Key == semconv.DBStatementKey && strings.Contains(attr.Value.AsString(), "Ivanov") {
+					t.Errorf("statement %q isn't redacted", attr.Value.AsString())
+				}
+			}
+		})
+	}
+}
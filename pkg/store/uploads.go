@@ -0,0 +1,466 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/JulianaOsi/medhelp/pkg/filestore"
+)
+
+// UploadSession is a resumable upload of an analysis file. Offset is how many
+// of its Length bytes have been received. FileId is set once the upload is
+// complete and the file is attached to the analysis.
+type UploadSession struct {
+	Id         string    `json:"id"`
+	AnalysisId int       `json:"analysisId"`
+	CreatedBy  *int      `json:"createdBy"`
+	Length     int64     `json:"length"`
+	Offset     int64     `json:"offset"`
+	Filename   string    `json:"filename"`
+	FileId     *int      `json:"fileId"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+var uploadSessionColumns = []interface{}{
+	"id", "analysis_id", "created_by", "length", "upload_offset", "filename", "file_id", "created_at", "expires_at",
+}
+
+type NewUploadSession struct {
+	AnalysisId int
+	CreatedBy  *int
+	Length     int64
+	Filename   string
+	ExpiresAt  time.Time
+}
+
+// Complete reports whether all bytes of the upload have been received.
+func (u *UploadSession) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// Expired reports whether the upload may no longer be continued.
+func (u *UploadSession) Expired() bool {
+	return !u.ExpiresAt.After(time.Now())
+}
+
+func (s *Store) CreateUploadSession(ctx context.Context, session NewUploadSession) (*UploadSession, error) {
+	ctx, span := startSpan(ctx, "CreateUploadSession")
+	defer span.End()
+
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate upload id: %v", err)
+	}
+
+	sql, _, err := goqu.Insert("upload_session").
+		Rows(goqu.Record{
+			"id":          id,
+			"analysis_id": session.AnalysisId,
+			"created_by":  session.CreatedBy,
+			"length":      session.Length,
+			"filename":    session.Filename,
+			"expires_at":  session.ExpiresAt,
+		}).
+		Returning(uploadSessionColumns...).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	created, err := readUploadSession(s.connPool.QueryRow(ctx, sql))
+	if foreignKeyViolation(err) == "upload_session_analysis_id_fkey" {
+		return nil, notFound("analysis_not_found", "there is no such analysis")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return created, nil
+}
+
+// GetUploadSession returns the upload, including an expired one that hasn't
+// been removed yet.
+func (s *Store) GetUploadSession(ctx context.Context, id string) (*UploadSession, error) {
+	ctx, span := startSpan(ctx, "GetUploadSession")
+	defer span.End()
+
+	sql, _, err := goqu.Select(uploadSessionColumns...).
+		From("upload_session").
+		Where(goqu.C("id").Eq(id)).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	session, err := readUploadSession(s.connPool.QueryRow(ctx, sql))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return session, nil
+}
+
+// AppendUploadChunk stores the content of r as the chunk of the upload that
+// starts at offset and extends the upload until expiresAt. It returns
+// ErrConflict if offset isn't where the upload currently ends, e.g. because
+// another request has appended the same chunk first, and ErrNotFound if the
+// upload doesn't exist or has expired.
+func (s *Store) AppendUploadChunk(ctx context.Context, id string, offset int64, r io.Reader, expiresAt time.Time) (*UploadSession, error) {
+	ctx, span := startSpan(ctx, "AppendUploadChunk")
+	defer span.End()
+
+	token, err := randomToken(8)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate chunk name: %v", err)
+	}
+	name := fmt.Sprintf("upload-%s-%d-%s", id, offset, token)
+
+	size, err := s.files.Put(ctx, name, r, -1, "application/octet-stream")
+	if err != nil {
+		return nil, fmt.Errorf("failed to store chunk: %v", err)
+	}
+
+	session, err := s.addUploadChunk(ctx, id, offset, size, name, expiresAt)
+	if err != nil || size == 0 {
+		// A chunk without a row is never read, so failing to remove it only
+		// wastes space and mustn't hide err.
+		s.files.Delete(ctx, name)
+	}
+	return session, err
+}
+
+// addUploadChunk moves the end of the upload past the stored chunk and
+// records it. An empty chunk only extends the upload.
+func (s *Store) addUploadChunk(ctx context.Context, id string, offset, size int64, name string, expiresAt time.Time) (*UploadSession, error) {
+	tx, err := s.connPool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql, _, err := goqu.Update("upload_session").
+		Set(goqu.Record{
+			"upload_offset": goqu.L("upload_offset + ?", size),
+			"expires_at":    expiresAt,
+		}).
+		Where(
+			goqu.C("id").Eq(id),
+			goqu.C("upload_offset").Eq(offset),
+			goqu.C("file_id").IsNull(),
+			goqu.C("expires_at").Gt(goqu.L("now()")),
+		).
+		Returning(uploadSessionColumns...).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	session, err := readUploadSession(tx.QueryRow(ctx, sql))
+	if err == pgx.ErrNoRows {
+		return nil, s.uploadUnavailable(ctx, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	if size > 0 {
+		sql, _, err = goqu.Insert("upload_chunk").
+			Rows(goqu.Record{
+				"session_id":   id,
+				"chunk_offset": offset,
+				"size":         size,
+				"name":         name,
+			}).
+			ToSQL()
+		if err != nil {
+			return nil, fmt.Errorf("sql query build failed: %v", err)
+		}
+
+		if _, err := tx.Exec(ctx, sql); err != nil {
+			return nil, fmt.Errorf("execute a query failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return session, nil
+}
+
+// uploadUnavailable explains why a chunk couldn't be appended to the upload.
+func (s *Store) uploadUnavailable(ctx context.Context, id string) error {
+	session, err := s.GetUploadSession(ctx, id)
+	if err != nil {
+		return err
+	}
+	if session == nil || session.Expired() {
+		return notFound("upload_not_found", "there is no such upload or it has expired")
+	}
+	return conflict("upload_offset_mismatch",
+		fmt.Sprintf("the upload is at offset %d and accepts no other", session.Offset))
+}
+
+// OpenUpload returns the received chunks of the upload joined together. The
+// caller must close the reader.
+func (s *Store) OpenUpload(ctx context.Context, id string) (io.ReadCloser, error) {
+	ctx, span := startSpan(ctx, "OpenUpload")
+	defer span.End()
+
+	names, err := s.getUploadChunks(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkReader{ctx: ctx, files: s.files, names: names}, nil
+}
+
+func (s *Store) getUploadChunks(ctx context.Context, id string) ([]string, error) {
+	sql, _, err := goqu.Select("name").
+		From("upload_chunk").
+		Where(goqu.C("session_id").Eq(id)).
+		Order(goqu.C("chunk_offset").Asc()).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := s.connPool.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("converting failed: %v", err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	return names, nil
+}
+
+// CompleteUploadSession stores the received upload as the file of its
+// analysis, like SaveAnalysisFile, and records the file the upload became in
+// the same transaction. It returns ErrConflict if the upload has already been
+// completed, e.g. by a concurrent request. The chunks are no longer needed;
+// any that can't be removed now are removed with the session when it expires.
+func (s *Store) CompleteUploadSession(ctx context.Context, session *UploadSession, upload NewFile, changedBy *int) (*File, error) {
+	ctx, span := startSpan(ctx, "CompleteUploadSession")
+	defer span.End()
+
+	var previous *DirectionStatus
+	var status DirectionStatus
+
+	file, err := s.saveFile(ctx, upload, func(tx pgx.Tx, file *File) error {
+		// Claiming the upload first makes a concurrent completion wait here
+		// and then find it taken.
+		if err := claimUploadSession(ctx, tx, session.Id, file.Id); err != nil {
+			return err
+		}
+
+		var err error
+		previous, status, err = setAnalysisFile(ctx, tx, session.AnalysisId, file, changedBy)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	countStatusChange(previous, status)
+	session.FileId = &file.Id
+	_ = s.deleteUploadChunks(ctx, session.Id)
+	return file, nil
+}
+
+// claimUploadSession records the file of the upload unless it already has
+// one.
+func claimUploadSession(ctx context.Context, q querier, id string, fileId int) error {
+	sql, _, err := goqu.Update("upload_session").
+		Set(goqu.Record{"file_id": fileId}).
+		Where(goqu.C("id").Eq(id), goqu.C("file_id").IsNull()).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	tag, err := q.Exec(ctx, sql)
+	if err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return conflict("upload_completed", "the upload has already been completed or removed")
+	}
+	return nil
+}
+
+// DeleteUploadSession removes the upload and its chunks.
+func (s *Store) DeleteUploadSession(ctx context.Context, id string) error {
+	ctx, span := startSpan(ctx, "DeleteUploadSession")
+	defer span.End()
+
+	if err := s.deleteUploadChunks(ctx, id); err != nil {
+		return err
+	}
+
+	sql, _, err := goqu.Delete("upload_session").
+		Where(goqu.C("id").Eq(id)).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	tag, err := s.connPool.Exec(ctx, sql)
+	if err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return notFound("upload_not_found", "there is no such upload")
+	}
+	return nil
+}
+
+// DeleteExpiredUploadSessions removes the uploads that have expired, finished
+// or not, and returns how many were removed.
+func (s *Store) DeleteExpiredUploadSessions(ctx context.Context) (int, error) {
+	ctx, span := startSpan(ctx, "DeleteExpiredUploadSessions")
+	defer span.End()
+
+	sql, _, err := goqu.Select("id").
+		From("upload_session").
+		Where(goqu.C("expires_at").Lte(goqu.L("now()"))).
+		ToSQL()
+	if err != nil {
+		return 0, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := s.connPool.Query(ctx, sql)
+	if err != nil {
+		return 0, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("converting failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("execute a query failed: %v", err)
+	}
+
+	var deleted int
+	for _, id := range ids {
+		err := s.DeleteUploadSession(ctx, id)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return deleted, fmt.Errorf("failed to delete upload %s: %v", id, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// deleteUploadChunks removes the chunks of the upload from the file storage
+// and then their rows, so a failure leaves nothing unaccounted for.
+func (s *Store) deleteUploadChunks(ctx context.Context, id string) error {
+	names, err := s.getUploadChunks(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := s.files.Delete(ctx, name); err != nil && err != filestore.ErrNotExist {
+			return fmt.Errorf("failed to remove chunk: %v", err)
+		}
+	}
+
+	sql, _, err := goqu.Delete("upload_chunk").
+		Where(goqu.C("session_id").Eq(id)).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	if _, err := s.connPool.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+	return nil
+}
+
+// chunkReader reads the named chunks one after another, opening each only
+// when the previous one is exhausted.
+type chunkReader struct {
+	ctx     context.Context
+	files   filestore.FileStorage
+	names   []string
+	current io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.names) == 0 {
+				return 0, io.EOF
+			}
+
+			chunk, _, err := c.files.Get(c.ctx, c.names[0])
+			if err != nil {
+				return 0, fmt.Errorf("failed to open chunk %s: %v", c.names[0], err)
+			}
+			c.current = chunk
+			c.names = c.names[1:]
+		}
+
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	return c.current.Close()
+}
+
+func readUploadSession(row pgx.Row) (*UploadSession, error) {
+	var u UploadSession
+
+	err := row.Scan(
+		&u.Id, &u.AnalysisId, &u.CreatedBy, &u.Length, &u.Offset, &u.Filename, &u.FileId,
+		&u.CreatedAt, &u.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
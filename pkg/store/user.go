@@ -4,46 +4,60 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
+
 	"github.com/doug-martin/goqu/v9"
 	"github.com/jackc/pgx/v4"
-	"math/rand"
-	"time"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// passwordHashCost is the bcrypt cost used for new hashes. Stored hashes with
+// a lower cost are upgraded on the next successful login.
+const passwordHashCost = 12
+
 type User struct {
-	Id        *int   `json:"user_id"`
-	Username  string `json:"username"`
-	Password  string `json:"password"`
-	Salt      string `json:"salt"`
-	Role      string `json:"role"`
-	RelatedId *int   `json:"related_id"`
+	Id           *int    `json:"user_id"`
+	Username     string  `json:"username"`
+	Password     string  `json:"password"`
+	Salt         *string `json:"salt"`
+	Role         string  `json:"role"`
+	RelatedId    *int    `json:"related_id"`
+	Organization *string `json:"organization"`
 }
 
 func (s *Store) CreateUser(ctx context.Context, username string, password string, role string) error {
-	var user User
-	user.Username = username
-	user.Salt = generateSalt(7)
-	user.Password = generateChecksum(password, user.Salt)
-	user.Role = role
+	ctx, span := startSpan(ctx, "CreateUser")
+	defer span.End()
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
 
 	sql, _, err := goqu.Insert("users").
 		Rows(goqu.Record{
-			"username": user.Username,
-			"password": user.Password,
-			"salt":     user.Salt,
-			"role":     user.Role,
+			"username": username,
+			"password": hash,
+			"role":     role,
 		}).ToSQL()
 	if err != nil {
 		return fmt.Errorf("sql query build failed: %v", err)
 	}
 	if _, err := s.connPool.Exec(ctx, sql); err != nil {
+		if isUniqueViolation(err) {
+			return conflict("username_taken", "user already exists")
+		}
 		return fmt.Errorf("execute a query failed: %v", err)
 	}
 	return nil
 }
 
 func (s *Store) AddRelatedIdToUser(ctx context.Context, username string, relatedId int) error {
+	ctx, span := startSpan(ctx, "AddRelatedIdToUser")
+	defer span.End()
+
 	sql, _, err := goqu.Update("users").
 		Set(goqu.Record{
 			"id_related": relatedId,
@@ -60,7 +74,10 @@ func (s *Store) AddRelatedIdToUser(ctx context.Context, username string, related
 }
 
 func (s *Store) IsRelatedIdSet(ctx context.Context, relatedId int) (*bool, error) {
-	sql, _, err := goqu.Select("id", "username", "password", "salt", "role", "id_related").
+	ctx, span := startSpan(ctx, "IsRelatedIdSet")
+	defer span.End()
+
+	sql, _, err := goqu.Select("id", "username", "password", "salt", "role", "id_related", "organization").
 		From("users").
 		Where(goqu.C("id_related").Eq(relatedId)).
 		ToSQL()
@@ -93,7 +110,10 @@ func (s *Store) IsRelatedIdSet(ctx context.Context, relatedId int) (*bool, error
 }
 
 func (s *Store) GetUserByUsername(ctx context.Context, username string) (*User, error) {
-	sql, _, err := goqu.Select("id", "username", "password", "salt", "role", "id_related").
+	ctx, span := startSpan(ctx, "GetUserByUsername")
+	defer span.End()
+
+	sql, _, err := goqu.Select("id", "username", "password", "salt", "role", "id_related", "organization").
 		From("users").
 		Where(goqu.C("username").Eq(username)).
 		ToSQL()
@@ -123,7 +143,47 @@ func (s *Store) GetUserByUsername(ctx context.Context, username string) (*User,
 	return users[0], nil
 }
 
+func (s *Store) GetUserById(ctx context.Context, id int) (*User, error) {
+	ctx, span := startSpan(ctx, "GetUserById")
+	defer span.End()
+
+	sql, _, err := goqu.Select("id", "username", "password", "salt", "role", "id_related", "organization").
+		From("users").
+		Where(goqu.C("id").Eq(id)).
+		ToSQL()
+	if err != nil {
+		return nil, fmt.Errorf("sql query build failed: %v", err)
+	}
+
+	rows, err := s.connPool.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("execute a query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var users []*User
+
+	for rows.Next() {
+		user, err := readUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("converting failed: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return users[0], nil
+}
+
+// IsPasswordCorrect checks the password against the stored hash. Legacy MD5
+// checksums are still accepted and are replaced with a bcrypt hash as soon as
+// the password is confirmed.
 func (s *Store) IsPasswordCorrect(ctx context.Context, username string, password string) (*bool, error) {
+	ctx, span := startSpan(ctx, "IsPasswordCorrect")
+	defer span.End()
+
 	user, err := s.GetUserByUsername(ctx, username)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get use: %v", err)
@@ -131,25 +191,86 @@ func (s *Store) IsPasswordCorrect(ctx context.Context, username string, password
 
 	var cond = false
 
-	if generateChecksum(password, user.Salt) == user.Password {
-		cond = true
+	if user == nil {
 		return &cond, nil
 	}
+
+	if isLegacyChecksum(user.Password) {
+		if user.Salt == nil || generateChecksum(password, *user.Salt) != user.Password {
+			return &cond, nil
+		}
+	} else if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return &cond, nil
+		}
+		return nil, fmt.Errorf("failed to compare password hash: %v", err)
+	}
+
+	// A legacy password too long for bcrypt keeps its checksum rather than
+	// being cut short.
+	if needsRehash(user.Password) && len(password) <= maxPasswordBytes {
+		if err := s.setPassword(ctx, *user.Id, password); err != nil {
+			return nil, fmt.Errorf("failed to upgrade password hash: %v", err)
+		}
+	}
+
+	cond = true
 	return &cond, nil
 }
 
-func generateSalt(n int) string {
-	rand.Seed(time.Now().UnixNano())
-	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+func (s *Store) setPassword(ctx context.Context, userId int, password string) error {
+	ctx, span := startSpan(ctx, "setPassword")
+	defer span.End()
 
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+	hash, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	return string(b)
+	sql, _, err := goqu.Update("users").
+		Set(goqu.Record{
+			"password": hash,
+			"salt":     nil,
+		}).
+		Where(goqu.C("id").Eq(userId)).
+		ToSQL()
+	if err != nil {
+		return fmt.Errorf("sql query build failed: %v", err)
+	}
+	if _, err := s.connPool.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("execute a query failed: %v", err)
+	}
+	return nil
+}
+
+// hashPassword returns a bcrypt hash in modular crypt format. The "$2a$"
+// prefix identifies the algorithm version and the cost is part of the hash.
+func hashPassword(password string) (string, error) {
+	if len(password) > maxPasswordBytes {
+		return "", invalid("password", "must be at most 72 bytes long")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func isLegacyChecksum(hash string) bool {
+	return !strings.HasPrefix(hash, "$2")
+}
+
+func needsRehash(hash string) bool {
+	if isLegacyChecksum(hash) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < passwordHashCost
 }
 
+// generateChecksum reproduces the legacy salted MD5 checksum. It is only used
+// to verify accounts that have not logged in since the bcrypt migration.
 func generateChecksum(password string, salt string) string {
 	var passwordChecksum = md5.Sum([]byte(password))
 	var saltChecksum = md5.Sum([]byte(salt))
@@ -161,7 +282,7 @@ func generateChecksum(password string, salt string) string {
 func readUser(row pgx.Row) (*User, error) {
 	var u User
 
-	err := row.Scan(&u.Id, &u.Username, &u.Password, &u.Salt, &u.Role, &u.RelatedId)
+	err := row.Scan(&u.Id, &u.Username, &u.Password, &u.Salt, &u.Role, &u.RelatedId, &u.Organization)
 	if err != nil {
 		return nil, err
 	}
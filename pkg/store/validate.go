@@ -0,0 +1,176 @@
+package store
+
+import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxTextLength = 255
+
+var (
+	// policyNumberPattern is the unified 16-digit compulsory medical
+	// insurance policy number.
+	policyNumberPattern = regexp.MustCompile(`^[0-9]{16}$`)
+	// legacyPolicyNumberPattern also accepts the shorter numbers of patients
+	// added before the unified format was required. Only addPatient can tell
+	// whether such a patient exists.
+	legacyPolicyNumberPattern = regexp.MustCompile(`^[0-9]{1,16}$`)
+	// telPattern is checked after spaces, dashes and parentheses are removed.
+	telPattern = regexp.MustCompile(`^\+?[0-9]{10,15}$`)
+	// icdCodePattern accepts a single ICD-10 code such as "K29" or "K29.7",
+	// or a range such as "E10-E14".
+	icdCodePattern  = regexp.MustCompile(`^[A-Z][0-9]{2}(\.[0-9]{1,2})?(-[A-Z][0-9]{2}(\.[0-9]{1,2})?)?$`)
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,50}$`)
+	// analysisCodePattern is the code of an analysis in the catalog, such as
+	// "blood-glucose".
+	analysisCodePattern = regexp.MustCompile(`^[a-z0-9._-]{1,50}$`)
+)
+
+var earliestBirthDate = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const minPasswordLength = 8
+
+// maxPasswordBytes is the longest password bcrypt hashes; it ignores any bytes
+// after the 72nd, so longer passwords would match any password with the same
+// beginning.
+const maxPasswordBytes = 72
+
+// Merge adds the fields of a validation error returned by a nested Validate,
+// prefixed with the path of the nested value, e.g. "directions[2].patient".
+func (e *ValidationError) Merge(prefix string, err error) {
+	nested, ok := err.(*ValidationError)
+	if !ok {
+		return
+	}
+	for _, f := range nested.Fields {
+		e.Add(prefix+"."+f.Field, f.Message)
+	}
+}
+
+func (p NewPatient) Validate() error {
+	var errs ValidationError
+
+	requireText(&errs, "first_name", p.FirstName)
+	requireText(&errs, "last_name", p.LastName)
+
+	switch {
+	case p.BirthDate.IsZero():
+		errs.Add("birth_date", "is required")
+	case !p.BirthDate.Before(time.Now()):
+		errs.Add("birth_date", "must be in the past")
+	case p.BirthDate.Before(earliestBirthDate):
+		errs.Add("birth_date", "must be after 1900-01-01")
+	}
+
+	if p.PolicyNumber == "" {
+		errs.Add("policy_number", "is required")
+	} else if !legacyPolicyNumberPattern.MatchString(p.PolicyNumber) {
+		errs.Add("policy_number", "must be 16 digits")
+	}
+
+	if p.Tel == "" {
+		errs.Add("tel", "is required")
+	} else if !telPattern.MatchString(normalizeTel(p.Tel)) {
+		errs.Add("tel", "must be a phone number of 10 to 15 digits")
+	}
+
+	return errs.Err()
+}
+
+func (d NewDoctor) Validate() error {
+	var errs ValidationError
+
+	requireText(&errs, "name", d.Name)
+	requireText(&errs, "specialty", d.Specialty)
+
+	return errs.Err()
+}
+
+// Validate checks the fields of a direction given by the client. PatientId
+// and DoctorId are assigned by the store and are checked by foreign keys.
+func (d NewDirection) Validate() error {
+	var errs ValidationError
+
+	switch {
+	case d.Date.IsZero():
+		errs.Add("date", "is required")
+	case d.Date.After(time.Now()):
+		errs.Add("date", "must not be in the future")
+	}
+
+	if d.IcdCode == "" {
+		errs.Add("icd_code", "is required")
+	} else if !icdCodePattern.MatchString(d.IcdCode) {
+		errs.Add("icd_code", "must be an ICD-10 code such as K29.7 or a range such as E10-E14")
+	}
+
+	requireText(&errs, "medical_organization", d.MedicalOrganization)
+	requireText(&errs, "organization_contact", d.OrganizationContact)
+	requireText(&errs, "justification", d.Justification)
+
+	return errs.Err()
+}
+
+func (a NewCatalogAnalysis) Validate() error {
+	var errs ValidationError
+
+	if a.Code == "" {
+		errs.Add("code", "is required")
+	} else if !analysisCodePattern.MatchString(a.Code) {
+		errs.Add("code", "must be 1 to 50 lowercase latin letters, digits, dots, dashes or underscores")
+	}
+
+	requireText(&errs, "name", a.Name)
+
+	if a.ValidityDays != nil && *a.ValidityDays <= 0 {
+		errs.Add("validity_days", "must be positive")
+	}
+
+	return errs.Err()
+}
+
+func (r NewIcdRule) Validate() error {
+	var errs ValidationError
+
+	if r.IcdCode == "" {
+		errs.Add("icd_code", "is required")
+	} else if !icdCodePattern.MatchString(r.IcdCode) {
+		errs.Add("icd_code", "must be an ICD-10 code such as K29.7 or a range such as E10-E14")
+	}
+
+	if r.AnalysisId == nil {
+		errs.Add("analysis_id", "is required")
+	}
+
+	return errs.Err()
+}
+
+// ValidateCredentials checks a username and password chosen at registration.
+func ValidateCredentials(errs *ValidationError, username string, password string) {
+	if username == "" {
+		errs.Add("username", "is required")
+	} else if !usernamePattern.MatchString(username) {
+		errs.Add("username", "must be 3 to 50 latin letters, digits, dots, dashes or underscores")
+	}
+
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		errs.Add("password", "must be at least 8 characters long")
+	} else if len(password) > maxPasswordBytes {
+		errs.Add("password", "must be at most 72 bytes long")
+	}
+}
+
+func requireText(errs *ValidationError, field string, value string) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		errs.Add(field, "is required")
+	} else if utf8.RuneCountInString(value) > maxTextLength {
+		errs.Add(field, "must be at most 255 characters long")
+	}
+}
+
+func normalizeTel(tel string) string {
+	return strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(tel)
+}
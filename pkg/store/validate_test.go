@@ -0,0 +1,74 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		fields   []string
+	}{
+		{name: "valid", username: "registrar.1", password: "correct horse"},
+		{name: "shortest password", username: "ivan", password: "12345678"},
+		{name: "longest password", username: "ivan", password: strings.Repeat("a", 72)},
+		{name: "non-ascii password", username: "ivan", password: strings.Repeat("пароль", 6)},
+		{name: "short password", username: "ivan", password: "1234567", fields: []string{"password"}},
+		{name: "short non-ascii password", username: "ivan", password: "пароль", fields: []string{"password"}},
+		{name: "password over 72 bytes", username: "ivan", password: strings.Repeat("a", 73), fields: []string{"password"}},
+		{
+			name:     "non-ascii password over 72 bytes",
+			username: "ivan",
+			password: strings.Repeat("пароль", 7),
+			fields:   []string{"password"},
+		},
+		{name: "no username", password: "correct horse", fields: []string{"username"}},
+		{name: "short username", username: "iv", password: "correct horse", fields: []string{"username"}},
+		{name: "non-latin username", username: "иван", password: "correct horse", fields: []string{"username"}},
+		{name: "nothing", fields: []string{"username", "password"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var errs ValidationError
+			ValidateCredentials(&errs, tt.username, tt.password)
+			checkFields(t, errs.Err(), tt.fields)
+		})
+	}
+}
+
+func TestHashPasswordTooLong(t *testing.T) {
+	_, err := hashPassword(strings.Repeat("a", 73))
+	checkFields(t, err, []string{"password"})
+}
+
+func TestValidatePolicyNumber(t *testing.T) {
+	tests := []struct {
+		name         string
+		policyNumber string
+		fields       []string
+	}{
+		{name: "unified", policyNumber: "1111111111111111"},
+		{name: "legacy", policyNumber: "222"},
+		{name: "missing", fields: []string{"policy_number"}},
+		{name: "over 16 digits", policyNumber: "11111111111111111", fields: []string{"policy_number"}},
+		{name: "not digits", policyNumber: "1111-1111-1111-11", fields: []string{"policy_number"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patient := NewPatient{
+				FirstName:    "Иван",
+				LastName:     "Иванов",
+				BirthDate:    time.Date(1999, 1, 8, 0, 0, 0, 0, time.UTC),
+				PolicyNumber: tt.policyNumber,
+				Tel:          "+79196853269",
+			}
+			checkFields(t, patient.Validate(), tt.fields)
+		})
+	}
+}
@@ -0,0 +1,30 @@
+// Package version holds build information. The variables are set at link
+// time, e.g.
+//
+//	go build -ldflags "-X github.com/JulianaOsi/medhelp/pkg/version.Version=1.2.0 \
+//		-X github.com/JulianaOsi/medhelp/pkg/version.Commit=$(git rev-parse HEAD)" ./cmd
+package version
+
+import "runtime"
+
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+}